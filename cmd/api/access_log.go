@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessLogEntry collects what the access log needs to know from inside the
+// middleware chain.
+type accessLogEntry struct {
+	userID int64
+}
+
+// logAccess writes one log entry per request. Requests to paths starting with one of
+// the -access-log-exclude prefixes are never logged, and of the rest only a
+// -access-log-sample fraction is. Server errors are always logged, whatever the
+// sampling rate.
+func (app *application) logAccess(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.accessLog.enabled || app.accessLogExcluded(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		entry := &accessLogEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey, entry))
+		rec := newResponseRecorder(w)
+
+		defer func() {
+			if rec.statusCode < http.StatusInternalServerError && rand.Float64() >= app.config.accessLog.sampleRate {
+				return
+			}
+
+			// The pattern starts with the method, which is logged on its own.
+			_, route, _ := strings.Cut(routePattern(router, r), " ")
+			properties := map[string]any{
+				"method":      r.Method,
+				"route":       route,
+				"status":      rec.statusCode,
+				"bytes":       rec.bytesWritten,
+				"duration_ms": time.Since(start),
+				"client_ip":   app.clientIP(r),
+			}
+			if entry.userID != 0 {
+				properties["user_id"] = entry.userID
+			}
+			app.requestLogger(r).PrintInfoFields("request", properties)
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func (app *application) accessLogExcluded(path string) bool {
+	for _, prefix := range app.config.accessLog.exclude {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gaproject.terminator8000.net/internal/data"
+	"gaproject.terminator8000.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	format := app.readString(r.URL.Query(), "format", "json")
+	if v.Check(validator.PermittedValue(format, "json", "zip"), "format", "must be json or zip"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID := app.contextGetUser(r).ID
+
+	export, err := app.collectUserData(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Audit.Insert(&data.AuditEntry{
+		UserID:  userID,
+		ActorID: userID,
+		Action:  data.AuditAccountExported,
+		Details: map[string]string{"format": format},
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "json" {
+		err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// In the ZIP archive every section of the export becomes its own JSON file. The
+	// archive is built in full before anything is written, so a failure part way
+	// through can still be reported as a normal error response.
+	buf, err := zipExport(export)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gaproject-export-%d.zip"`, userID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// collectUserData gathers everything we hold about a user.
+func (app *application) collectUserData(userID int64) (envelope, error) {
+	user, err := app.models.UserInfo.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := app.models.Tokens.GetMetadataForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAll(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactorEnabled, err := app.models.TwoFactor.IsEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := app.models.Audit.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, err := app.models.Outbox.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	// Pending messages can still hold live one-time tokens, which don't belong in an
+	// export file that may be kept around, so they are hidden as in the admin API.
+	for _, m := range mail {
+		m.Redact()
+	}
+
+	export := envelope{
+		"profile":     user,
+		"permissions": permissions,
+		"tokens":      tokens,
+		"api_keys":    apiKeys,
+		"two_factor":  map[string]bool{"enabled": twoFactorEnabled},
+		"audit_log":   auditLog,
+		"mail":        mail,
+		"exported_at": time.Now().UTC(),
+	}
+
+	lockout, err := app.models.Lockouts.Get(loginUserKey(userID))
+	switch {
+	case err == nil:
+		export["lockout"] = lockout
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	deletion, err := app.models.Deletions.Get(userID)
+	switch {
+	case err == nil:
+		export["deletion"] = deletion
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func zipExport(export envelope) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for name, section := range export {
+		f, err := zw.Create(name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		js, err := json.MarshalIndent(section, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(append(js, '\n'))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (app *application) cancelDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.UserInfo.GetForToken(data.ScopeDeletionCancel, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired cancellation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The deletion request, the reactivation, the cancellation token and the audit
+	// entry are changed together, so a failure can't leave a reactivated account
+	// which is still due to be purged.
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		err := tx.Deletions.Cancel(user.ID)
+		if err != nil {
+			return err
+		}
+
+		user.Activated = true
+		err = tx.UserInfo.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Tokens.Delete(data.ScopeDeletionCancel, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			UserID:  user.ID,
+			ActorID: user.ID,
+			Action:  data.AuditAccountDeletionCancelled,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired cancellation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account deletion cancelled, you can log in again"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedAccounts permanently deletes every account whose deletion grace period
+// has ended. Related rows are removed by the ON DELETE CASCADE foreign keys. It runs
+// as a background job.
+func (app *application) purgeDeletedAccounts(ctx context.Context) error {
+	ids, err := app.models.Deletions.GetDue()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err = app.models.Transaction(func(tx data.TxModels) error {
+			err := tx.UserInfo.Delete(id)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				return err
+			}
+
+			return tx.Audit.Insert(&data.AuditEntry{
+				UserID: id,
+				Action: data.AuditAccountPurged,
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		// Lockout records are keyed by text rather than by a foreign key, so they
+		// aren't removed by the cascade.
+		err = app.models.Lockouts.Reset(loginUserKey(id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
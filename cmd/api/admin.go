@@ -0,0 +1,135 @@
+package main
+
+import (
+	"gaproject.terminator8000.net/internal/data"
+	"gaproject.terminator8000.net/internal/jsonlog"
+	"gaproject.terminator8000.net/internal/validator"
+	"net/http"
+	"strconv"
+)
+
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"jobs": app.jobs.Statuses()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLogLevelHandler changes the minimum log level until the next restart, when
+// the -log-level flag applies again.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	level, err := jsonlog.ParseLevel(input.Level)
+	v := validator.New()
+	v.Check(input.Level != "", "level", "must be provided")
+	v.Check(input.Level == "" || err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+	// Log at WARN so the change is recorded unless logging is nearly switched off.
+	app.requestLogger(r).PrintWarnFields("log level changed", map[string]any{
+		"from":    previous,
+		"to":      level,
+		"user_id": app.contextGetUser(r).ID,
+	})
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	required, err := app.adminTwoFactorRequired()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"two_factor": map[string]bool{"require_for_admins": required}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateTwoFactorPolicyHandler sets whether admins must use two-factor
+// authentication. The setting is stored, so it applies to every instance and
+// overrides the -2fa-require-admins flag from then on.
+func (app *application) updateTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RequireForAdmins *bool `json:"require_for_admins"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.RequireForAdmins != nil, "require_for_admins", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Turning the requirement on without 2FA would lock the admin out of the
+	// endpoint they need to turn it off again.
+	if *input.RequireForAdmins && app.contextGetAPIKey(r) == nil {
+		enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if v.Check(enabled, "require_for_admins", "enable two-factor authentication on your own account first"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		err := tx.Settings.SetBool(data.SettingRequireAdminTwoFactor, *input.RequireForAdmins)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			UserID:  user.ID,
+			ActorID: user.ID,
+			Action:  data.AuditSettingChanged,
+			Details: map[string]string{
+				"setting": data.SettingRequireAdminTwoFactor,
+				"value":   strconv.FormatBool(*input.RequireForAdmins),
+			},
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.requestLogger(r).PrintWarnFields("admin two-factor requirement changed", map[string]any{
+		"require_for_admins": *input.RequireForAdmins,
+		"user_id":            user.ID,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"two_factor": map[string]bool{"require_for_admins": *input.RequireForAdmins}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,13 +2,26 @@ package main
 
 import (
 	"fmt"
+	"gaproject.terminator8000.net/internal/jsonlog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// requestLogger returns a logger which adds the request ID to every entry.
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	requestID := app.contextGetRequestID(r)
+	if requestID == "" {
+		return app.logger
+	}
+	return app.logger.With(map[string]string{"request_id": requestID})
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	// Use the PrintError() method to log the error message, and include the current
 	// request method and URL as properties in the log entry.
-	app.logger.PrintError(err, map[string]string{
+	app.requestLogger(r).PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -16,6 +29,11 @@ func (app *application) logError(r *http.Request, err error) {
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	env := envelope{"error": message}
+	// Clients can quote the request ID when reporting a problem, so that it can be
+	// matched with our logs.
+	if requestID := app.contextGetRequestID(r); requestID != "" {
+		env["request_id"] = requestID
+	}
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -71,3 +89,45 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	message := "your user account must be activated to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) tooManyAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	// Round up, so that a client retrying after exactly Retry-After seconds isn't
+	// rejected again.
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := "too many failed attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "admin accounts must enable two-factor authentication at POST /v1/me/2fa to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	message := "invalid or missing API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) apiKeyIPNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this API key can't be used from your IP address"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) accountPendingDeletionResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this account is scheduled for deletion, use the token we emailed you to cancel the deletion"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
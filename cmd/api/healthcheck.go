@@ -1,9 +1,29 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"gaproject.terminator8000.net/internal/data"
 	"net/http"
+	"sync"
+	"time"
 )
 
+const (
+	// healthCheckTimeout bounds each readiness check.
+	healthCheckTimeout = 2 * time.Second
+	// jobMaxFailures is how many times in a row a background job may fail before the
+	// instance reports itself as not ready.
+	jobMaxFailures = 3
+)
+
+// checkResult is the outcome of a single readiness check.
+type checkResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
 		"status": "available",
@@ -18,3 +38,107 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// livenessHandler reports that the process is up and serving requests. It doesn't
+// check any dependencies: a database outage should take the instance out of the load
+// balancer, not get it restarted.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readinessHandler runs every dependency check concurrently, and responds 503 if any
+// of them fails, so that the orchestrator stops routing traffic to this instance. It
+// is public, so it only reports the status and latency of each check; the errors can
+// hold hostnames, paths and driver messages, and are only shown by
+// readinessDetailHandler.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeReadiness(w, r, false)
+}
+
+// readinessDetailHandler is readinessHandler with the error of each failing check,
+// for admins.
+func (app *application) readinessDetailHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeReadiness(w, r, true)
+}
+
+func (app *application) writeReadiness(w http.ResponseWriter, r *http.Request, detail bool) {
+	checks := map[string]func(ctx context.Context) error{
+		"database":   app.models.Health.Ping,
+		"migrations": app.checkMigrations,
+		"mail":       app.mailer.Ping,
+		"jobs": func(ctx context.Context) error {
+			return app.jobs.Health(jobMaxFailures)
+		},
+	}
+
+	results := make(map[string]checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			result := runCheck(r.Context(), check)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	env := envelope{"status": "ready", "checks": results}
+	for name, result := range results {
+		if result.Status != "ok" {
+			status = http.StatusServiceUnavailable
+			env["status"] = "unavailable"
+		}
+		if !detail {
+			result.Error = ""
+			results[name] = result
+		}
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func runCheck(ctx context.Context, check func(ctx context.Context) error) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := checkResult{
+		Status:  "ok",
+		Latency: time.Since(start).String(),
+	}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkMigrations makes sure the database schema is at least as new as this build
+// expects. A newer schema is fine, so that the database can be migrated ahead of a
+// rolling deploy.
+func (app *application) checkMigrations(ctx context.Context) error {
+	current, dirty, err := app.models.Health.MigrationVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migration %d failed and left the schema dirty", current)
+	}
+	if current < data.SchemaVersion {
+		return fmt.Errorf("schema is at version %d, but this build needs %d", current, data.SchemaVersion)
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"gaproject.terminator8000.net/internal/data"
 	"gaproject.terminator8000.net/internal/validator"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -141,13 +143,26 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-func (app *application) background(fn func()) {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
-			}
-		}()
-		fn()
-	}()
+// clientIP returns the IP address of the client that made the request, without the
+// port number.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// preferredLocale returns the first supported locale listed in the request's
+// Accept-Language header, or English if there is none. Quality values are ignored,
+// as clients list languages in order of preference anyway.
+func (app *application) preferredLocale(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag, _, _ = strings.Cut(strings.ToLower(tag), "-")
+		if validator.PermittedValue(tag, data.Locales...) {
+			return tag
+		}
+	}
+	return data.LocaleEnglish
 }
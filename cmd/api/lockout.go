@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gaproject.terminator8000.net/internal/data"
+	"net/http"
+	"time"
+)
+
+// failureWindow is how long a failed attempt is remembered for. A key with no
+// failures in this window starts counting from zero again.
+const failureWindow = time.Hour
+
+// lockoutDelay returns how long a key must wait before its next attempt. Once the
+// threshold is reached the key is locked for the full lockout duration. Below it the
+// delay halves for every failure short of the threshold, so that the backoff scales
+// with the key's own threshold, and delays under a second are skipped. With the
+// defaults, an account waits about 4s after its second failure, while a client IP
+// isn't slowed down until around its 40th.
+func lockoutDelay(failures, threshold int, duration time.Duration) time.Duration {
+	if failures >= threshold {
+		return duration
+	}
+	if failures < 2 {
+		return 0
+	}
+
+	shift := threshold - failures
+	if shift > 62 {
+		return 0
+	}
+	delay := duration >> shift
+	if delay < time.Second {
+		return 0
+	}
+	return delay
+}
+
+// checkLockout sends a 429 response and returns false if the key is currently locked.
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, key string) bool {
+	remaining, err := app.models.Lockouts.RemainingLock(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if remaining > 0 {
+		app.tooManyAttemptsResponse(w, r, remaining)
+		return false
+	}
+	return true
+}
+
+// recordFailedAttempt counts a failure against the key and applies the resulting
+// backoff. It returns true when this failure is the one that locked the key.
+func (app *application) recordFailedAttempt(key string, threshold int) (bool, error) {
+	failures, err := app.models.Lockouts.RecordFailure(key, failureWindow)
+	if err != nil {
+		return false, err
+	}
+
+	delay := lockoutDelay(failures, threshold, app.config.lockout.duration)
+	if delay > 0 {
+		err = app.models.Lockouts.Lock(key, delay)
+		if err != nil {
+			return false, err
+		}
+	}
+	return failures == threshold, nil
+}
+
+// recordFailedLogin counts a failed login against the client IP and, when the email
+// address belongs to an account, against that account too. The account owner is
+// emailed when their account gets locked.
+func (app *application) recordFailedLogin(r *http.Request, user *data.User) error {
+	ip := app.clientIP(r)
+
+	_, err := app.recordFailedAttempt(loginIPKey(ip), app.config.lockout.ipThreshold)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	locked, err := app.recordFailedAttempt(loginUserKey(user.ID), app.config.lockout.threshold)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		app.requestLogger(r).PrintWarnFields("account locked", map[string]any{
+			"user_id": user.ID,
+			"ip":      ip,
+		})
+
+		return app.models.Outbox.Insert(&data.Mail{
+			UserID:    user.ID,
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "account_locked.tmpl",
+			RequestID: app.contextGetRequestID(r),
+			Data: map[string]any{
+				"lockoutMinutes": int(app.config.lockout.duration.Minutes()),
+				"ip":             ip,
+			},
+		})
+	}
+	return nil
+}
+
+// recordSuccessfulLogin clears the account's failures, and takes one failure off the
+// client IP. The IP count is only decayed, not reset, so that an attacker with one
+// valid account can't use it to wipe the count between guesses at other accounts,
+// while a shared NAT doesn't keep every typo for the whole failure window.
+func (app *application) recordSuccessfulLogin(r *http.Request, user *data.User) error {
+	err := app.models.Lockouts.Reset(loginUserKey(user.ID))
+	if err != nil {
+		return err
+	}
+	return app.models.Lockouts.Forgive(loginIPKey(app.clientIP(r)))
+}
+
+func loginIPKey(ip string) string {
+	return "login-ip:" + ip
+}
+
+func loginUserKey(userID int64) string {
+	return fmt.Sprintf("login-user:%d", userID)
+}
+
+func activationIPKey(ip string) string {
+	return "activation-ip:" + ip
+}
+
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.UserInfo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Lockouts.Reset(loginUserKey(id))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	const duration = 15 * time.Minute
+
+	tests := []struct {
+		name      string
+		failures  int
+		threshold int
+		want      time.Duration
+	}{
+		{"first failure", 1, 10, 0},
+		{"second failure", 2, 10, duration >> 8},
+		{"one short of the threshold", 9, 10, duration / 2},
+		{"at the threshold", 10, 10, duration},
+		{"past the threshold", 25, 10, duration},
+		{"ip below a second", 40, 50, 0},
+		{"ip first delay", 41, 50, duration >> 9},
+		{"ip at the threshold", 50, 50, duration},
+		{"huge threshold", 2, 1000, 0},
+		{"threshold of one", 1, 1, duration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lockoutDelay(tt.failures, tt.threshold, duration)
+			if got != tt.want {
+				t.Errorf("lockoutDelay(%d, %d) = %s, want %s", tt.failures, tt.threshold, got, tt.want)
+			}
+		})
+	}
+}
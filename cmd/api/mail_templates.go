@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gaproject.terminator8000.net/internal/mailer"
+	"gaproject.terminator8000.net/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+)
+
+// templatePreview is a template rendered with mailer.SampleData.
+type templatePreview struct {
+	Name      string `json:"name"`
+	Locale    string `json:"locale"`
+	Subject   string `json:"subject"`
+	PlainBody string `json:"plain_body"`
+	HTMLBody  string `json:"html_body"`
+}
+
+// previewTemplate renders a template with the sample data. It returns an error if
+// the template or the locale doesn't exist.
+func previewTemplate(name, locale string) (*templatePreview, error) {
+	locales, err := mailer.Locales()
+	if err != nil {
+		return nil, err
+	}
+	if !validator.PermittedValue(locale, locales...) {
+		return nil, fmt.Errorf("unknown locale %q", locale)
+	}
+
+	names, err := mailer.Templates(mailer.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+	if !validator.PermittedValue(name, names...) {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+
+	msg, err := mailer.Render(locale, name, mailer.SampleData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templatePreview{
+		Name:      name,
+		Locale:    locale,
+		Subject:   msg.Subject,
+		PlainBody: msg.PlainBody,
+		HTMLBody:  msg.HTMLBody,
+	}, nil
+}
+
+func (app *application) listMailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	locales, err := mailer.Locales()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	names, err := mailer.Templates(mailer.DefaultLocale)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"locales": locales, "templates": names}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) previewMailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	v := validator.New()
+	qs := r.URL.Query()
+	locale := app.readString(qs, "locale", mailer.DefaultLocale)
+	format := app.readString(qs, "format", "json")
+
+	locales, err := mailer.Locales()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v.Check(validator.PermittedValue(locale, locales...), "locale", "unknown locale")
+	v.Check(validator.PermittedValue(format, "json", "html"), "format", "must be json or html")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	names, err := mailer.Templates(mailer.DefaultLocale)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !validator.PermittedValue(name, names...) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	preview, err := previewTemplate(name, locale)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, preview.HTMLBody)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"template": preview}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runMailerCommand implements the "mailer" subcommand:
+//
+//	api mailer lint
+//	api mailer preview -template activation.tmpl [-locale ru] [-format json|html]
+func runMailerCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: mailer lint | mailer preview -template name [-locale locale] [-format json|html]")
+	}
+
+	switch args[0] {
+	case "lint":
+		err := mailer.Check()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "all templates OK")
+		return nil
+
+	case "preview":
+		fs := flag.NewFlagSet("mailer preview", flag.ContinueOnError)
+		name := fs.String("template", "", "Template to render, e.g. activation.tmpl")
+		locale := fs.String("locale", mailer.DefaultLocale, "Locale to render the template in")
+		format := fs.String("format", "json", "Output format (json|html)")
+		err := fs.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+		if *name == "" {
+			names, err := mailer.Templates(mailer.DefaultLocale)
+			if err != nil {
+				return err
+			}
+			for _, n := range names {
+				fmt.Fprintln(stdout, n)
+			}
+			return nil
+		}
+
+		preview, err := previewTemplate(*name, *locale)
+		if err != nil {
+			return err
+		}
+
+		switch *format {
+		case "html":
+			_, err = io.WriteString(stdout, preview.HTMLBody)
+			return err
+		case "json":
+			enc := json.NewEncoder(stdout)
+			enc.SetIndent("", "\t")
+			return enc.Encode(preview)
+		default:
+			return fmt.Errorf("invalid format %q", *format)
+		}
+
+	default:
+		return fmt.Errorf("unknown mailer command %q", args[0])
+	}
+}
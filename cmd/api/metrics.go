@@ -0,0 +1,130 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseRecorder records the status code and body size written by a handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode    int
+	bytesWritten  int
+	headerWritten bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if !rec.headerWritten {
+		rec.statusCode = statusCode
+		rec.headerWritten = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.headerWritten = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytesWritten += n
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// recordMetrics counts every request and records its latency against the route
+// pattern it matched in router.
+func (app *application) recordMetrics(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		app.metrics.RequestStarted()
+
+		rec := newResponseRecorder(w)
+		defer func() {
+			app.metrics.RequestFinished(routePattern(router, r), rec.statusCode, time.Since(start))
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// routePattern returns the method and route pattern that a request matches, such as
+// "GET /v1/movies/:id". Requests which don't match a route are grouped together, so
+// that scanners can't create a histogram per path, and so are unknown methods, since
+// net/http accepts any token as a method.
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return metricsMethod(r.Method) + " unmatched"
+	}
+
+	// A parameter value can also appear as a static segment elsewhere in the path, as
+	// in /v1/admin/mail/templates/mail. To find the segment the value actually came
+	// from, swap a placeholder into each candidate and see whether the router returns
+	// it as the parameter.
+	const placeholder = "\x00"
+	segments := strings.Split(r.URL.Path, "/")
+	for _, p := range params {
+		for i, segment := range segments {
+			if segment != p.Value {
+				continue
+			}
+			segments[i] = placeholder
+			_, candidate, _ := router.Lookup(r.Method, strings.Join(segments, "/"))
+			if candidate.ByName(p.Key) == placeholder {
+				segments[i] = ":" + p.Key
+				break
+			}
+			segments[i] = segment
+		}
+	}
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
+// expvarHandler serves the published expvar variables as JSON, like expvar.Handler,
+// but leaves out the command line, which contains the database DSN and the SMTP
+// password.
+func (app *application) expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+func (app *application) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := app.metrics.WritePrometheus(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// metricsMethod returns the method for use in a metric name, or "OTHER" if it isn't
+// one of the standard methods.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
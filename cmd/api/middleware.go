@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"gaproject.terminator8000.net/internal/data"
+	"gaproject.terminator8000.net/internal/ratelimit"
 	"gaproject.terminator8000.net/internal/validator"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -22,7 +28,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		switch headerParts[0] {
+		case "Bearer":
+		case "ApiKey":
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		default:
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
@@ -36,6 +52,34 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Signed access tokens carry everything we need in their claims, so they are
+		// verified without touching the database.
+		if data.IsSignedToken(token) {
+			if app.tokenKeys == nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			claims, err := app.tokenKeys.Verify(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// Signed tokens are only ever issued to activated users.
+			user := &data.User{
+				ID:        claims.UserID,
+				Role:      claims.Role,
+				Activated: true,
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		user, err := app.models.UserInfo.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
@@ -47,12 +91,71 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		err = app.models.Tokens.Touch(token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAPIKey handles requests using the "Authorization: ApiKey <key>" scheme.
+// The request runs as the service account which owns the key.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, keyPlaintext string) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForPlaintext(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !key.AllowsIP(app.clientIP(r)) {
+		app.apiKeyIPNotAllowedResponse(w, r)
+		return
+	}
+
+	user, err := app.models.UserInfo.Get(key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Role != data.RoleService {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Touch(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -65,7 +168,7 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use the contextGetUser() helper that we made earlier to retrieve the user
 		// information from the request context.
@@ -76,6 +179,13 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 			app.authenticationRequiredResponse(w, r)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
 		// If the user is not activated, use the inactiveAccountResponse() helper to
 		// inform them that they need to activate their account.
 		if !user.Activated {
@@ -84,5 +194,239 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 		}
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
+	}
+	// Anonymous users are rejected by requireAuthenticatedUser() before the activation
+	// check runs.
+	return app.requireAuthenticatedUser(fn)
+}
+
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.permissionsFor(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		if !app.checkAdminTwoFactor(w, r, user, permissions) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	// Wrap this with the requireActivatedUser() middleware, so the permission check
+	// only ever runs for activated, non-anonymous users.
+	return app.requireActivatedUser(fn)
+}
+
+// requireOwnerOrAdmin only lets a request through when the :id route parameter refers
+// to the authenticated user themselves, or when the user holds the users:admin
+// permission.
+func (app *application) requireOwnerOrAdmin(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+		if user.ID != id {
+			permissions, err := app.permissionsFor(r, user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !permissions.Include(data.PermissionUsersAdmin) {
+				app.notPermittedResponse(w, r)
+				return
+			}
+
+			if !app.checkAdminTwoFactor(w, r, user, permissions) {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// permissionsFor returns the permissions the current request may use. Requests made
+// with an API key are limited to the permissions listed on the key.
+func (app *application) permissionsFor(r *http.Request, user *data.User) (data.Permissions, error) {
+	if key := app.contextGetAPIKey(r); key != nil {
+		return key.Permissions, nil
+	}
+	return app.models.Permissions.GetAllForUser(user.ID)
+}
+
+// adminTwoFactorRequired reports whether admins must use two-factor authentication.
+// The -2fa-require-admins flag applies until an admin changes the setting.
+func (app *application) adminTwoFactorRequired() (bool, error) {
+	required, err := app.models.Settings.GetBool(data.SettingRequireAdminTwoFactor)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return app.config.twoFactor.requireForAdmins, nil
+	}
+	return required, err
+}
+
+// checkAdminTwoFactor sends a 403 response and returns false when two-factor
+// authentication is required for admins and an admin user hasn't enabled it yet.
+func (app *application) checkAdminTwoFactor(w http.ResponseWriter, r *http.Request, user *data.User, permissions data.Permissions) bool {
+	if !permissions.Include(data.PermissionUsersAdmin) {
+		return true
+	}
+	// Service accounts can't complete a TOTP challenge; their API keys are already
+	// restricted by permission and IP address instead.
+	if app.contextGetAPIKey(r) != nil {
+		return true
+	}
+
+	required, err := app.adminTwoFactorRequired()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !required {
+		return true
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !enabled {
+		app.twoFactorRequiredResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// rateLimit limits requests with limiter. Authenticated requests are counted per
+// user, so that users behind a shared NAT don't throttle each other, and anonymous
+// requests per client IP. It must run after authenticate.
+func (app *application) rateLimit(limiter *ratelimit.Limiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := "ip:" + app.clientIP(r)
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			key = fmt.Sprintf("user:%d", user.ID)
+		}
+		app.limit(w, r, limiter, key, next)
+	}
+}
+
+// rateLimitIP limits every request per client IP, before authenticate, so that
+// floods of requests with bad credentials are throttled before they cost a database
+// lookup. It is meant to be used with a much looser limiter than rateLimit, since
+// authenticated users behind a shared NAT all draw from the same bucket.
+func (app *application) rateLimitIP(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.limit(w, r, limiter, "ip:"+app.clientIP(r), next)
 	})
 }
+
+// limit takes a token from key's bucket and calls next, or responds 429 if the bucket
+// is empty. The RateLimit headers describe the innermost limit applied.
+func (app *application) limit(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, key string, next http.Handler) {
+	if !app.config.limiter.enabled {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	result := limiter.Allow(key)
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+	if !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result.RetryAfter)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// cleanupRateLimiters forgets the clients whose buckets have refilled. It runs as a
+// background job on every instance.
+func (app *application) cleanupRateLimiters(ctx context.Context) error {
+	app.limiters.ip.Cleanup()
+	app.limiters.general.Cleanup()
+	app.limiters.auth.Cleanup()
+	return nil
+}
+
+// enableCORS lets browser front-ends on the trusted origins call the API, with
+// credentials. Requests from any other origin get no CORS headers, so the browser
+// blocks them. Preflight requests are answered here, before authentication.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Origin header, so caches must not share it
+		// between origins, even when no CORS headers are set.
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && validator.PermittedValue(origin, app.config.cors.trustedOrigins...) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID gives every request an ID, which is echoed in the X-Request-ID response
+// header and included in log entries and error responses. A well-formed ID sent by
+// the client or a proxy in front of us is kept, so the request can be traced across
+// services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// validRequestID reports whether a client-supplied request ID is safe to log: at most
+// 128 characters of letters, digits, dots, dashes and underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
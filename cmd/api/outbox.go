@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gaproject.terminator8000.net/internal/data"
+	"gaproject.terminator8000.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+const (
+	// outboxBatchSize is the most queued emails sent in a single run of the delivery job.
+	outboxBatchSize = 50
+	// outboxBaseRetry is the delay after the first failed delivery. It doubles with
+	// every further failure, up to outboxMaxRetry.
+	outboxBaseRetry = 30 * time.Second
+	outboxMaxRetry  = time.Hour
+)
+
+// deliverMail sends the queued emails which are due. Failed emails are retried with
+// exponential backoff, and moved to the dead-letter state once they have used up
+// their attempts. It runs as a background job.
+func (app *application) deliverMail(ctx context.Context) error {
+	mails, err := app.models.Outbox.GetDue(outboxBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, mail := range mails {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		sendErr := app.mailer.Send(mail.Recipient, mail.Locale, mail.Template, mail.Data)
+		if sendErr == nil {
+			err = app.models.Outbox.MarkSent(mail.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := mail.Attempts + 1
+		dead := attempts >= app.config.outbox.maxAttempts
+		err = app.models.Outbox.MarkFailed(mail.ID, sendErr, outboxRetryDelay(attempts), dead)
+		if err != nil {
+			return err
+		}
+
+		properties := map[string]string{
+			"mail_id":  fmt.Sprint(mail.ID),
+			"template": mail.Template,
+			"attempts": fmt.Sprint(attempts),
+		}
+		if mail.RequestID != "" {
+			properties["request_id"] = mail.RequestID
+		}
+		if dead {
+			properties["status"] = data.MailStatusDead
+		}
+		app.logger.PrintError(sendErr, properties)
+	}
+	return nil
+}
+
+// purgeMailOutbox removes the sent and dead emails older than the retention period,
+// so that the outbox doesn't keep addresses and template data forever. It runs as a
+// background job.
+func (app *application) purgeMailOutbox(ctx context.Context) error {
+	n, err := app.models.Outbox.DeleteFinished(app.config.outbox.retention)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		app.logger.PrintInfoFields("purged mail outbox", map[string]any{"deleted": n})
+	}
+	return nil
+}
+
+// outboxRetryDelay returns the delay before the next delivery of an email which has
+// failed the given number of times.
+func outboxRetryDelay(attempts int) time.Duration {
+	if attempts > 20 {
+		attempts = 20
+	}
+	delay := outboxBaseRetry << (attempts - 1)
+	if delay > outboxMaxRetry || delay <= 0 {
+		delay = outboxMaxRetry
+	}
+	return delay
+}
+
+func (app *application) listMailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.MailStatusDead)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-id"
+	input.Filters.SortSafelist = []string{"-id"}
+
+	v.Check(validator.PermittedValue(input.Status, data.MailStatusPending, data.MailStatusSent, data.MailStatusDead), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mails, err := app.models.Outbox.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Pending messages still hold their one-time tokens, which would let an admin act
+	// as the recipient.
+	for _, mail := range mails {
+		mail.Redact()
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"mail": mails}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) requeueMailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Outbox.Requeue(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrMailRedacted):
+			app.errorResponse(w, r, http.StatusConflict, "this email held a one-time token which has been discarded; the user must request a new email")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "mail queued for delivery"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"gaproject.terminator8000.net/internal/data"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
@@ -10,28 +11,84 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requireActivatedUser(app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requireActivatedUser(app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requireActivatedUser(app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requireActivatedUser(app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requireActivatedUser(app.deleteMovieHandler))
+	// Every request counts against the general limit. The unauthenticated endpoints
+	// which check credentials or tokens are also subject to the much stricter auth
+	// limit, to slow down guessing.
 
-	router.HandlerFunc(http.MethodPost, "/v1/moduleinfo", app.createModuleInfoHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/moduleinfo/:id", app.showModuleInfoHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/moduleinfo/:id", app.updateModuleInfoHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/moduleinfo/:id", app.deleteModuleInfoHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/ready", app.readinessHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/departamentinfo", app.createDepInfoHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/departamentinfo/:id", app.getDepInfoHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission(data.PermissionMoviesRead, app.listMoviesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission(data.PermissionMoviesWrite, app.createMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission(data.PermissionMoviesRead, app.showMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission(data.PermissionMoviesWrite, app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission(data.PermissionMoviesWrite, app.deleteMovieHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/moduleinfo", app.requirePermission(data.PermissionModulesWrite, app.createModuleInfoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/moduleinfo/:id", app.requirePermission(data.PermissionModulesRead, app.showModuleInfoHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/moduleinfo/:id", app.requirePermission(data.PermissionModulesWrite, app.updateModuleInfoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/moduleinfo/:id", app.requirePermission(data.PermissionModulesWrite, app.deleteModuleInfoHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/userinfo", app.createUserInfoHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/userinfo/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/userinfo", app.getAllUserInfoHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/userinfo/:id", app.getUserInfoHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/userinfo/:id", app.editUserInfoHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/userinfo/:id", app.deleteUserInfoHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/departamentinfo", app.requirePermission(data.PermissionModulesWrite, app.createDepInfoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/departamentinfo/:id", app.requirePermission(data.PermissionModulesRead, app.getDepInfoHandler))
 
-	return app.recoverPanic(app.authenticate(router))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.rateLimit(app.limiters.auth, app.createAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.rateLimit(app.limiters.auth, app.refreshAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/sessions/:id", app.requireAuthenticatedUser(app.revokeSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", app.rateLimit(app.limiters.auth, app.createTwoFactorTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.rateLimit(app.limiters.auth, app.createPasswordResetTokenHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/userinfo", app.rateLimit(app.limiters.auth, app.createUserInfoHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/userinfo/activated", app.rateLimit(app.limiters.auth, app.activateUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/userinfo/password", app.rateLimit(app.limiters.auth, app.updateUserPasswordHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/userinfo/email/confirm", app.rateLimit(app.limiters.auth, app.confirmEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/userinfo/email/cancel", app.rateLimit(app.limiters.auth, app.cancelEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/userinfo/deletion/cancel", app.rateLimit(app.limiters.auth, app.cancelDeletionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/userinfo", app.requirePermission(data.PermissionUsersAdmin, app.getAllUserInfoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/userinfo/:id", app.requireOwnerOrAdmin(app.getUserInfoHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/userinfo/:id", app.requireOwnerOrAdmin(app.editUserInfoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/userinfo/:id", app.requireOwnerOrAdmin(app.deleteUserInfoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/userinfo/:id/lockout", app.requirePermission(data.PermissionUsersAdmin, app.unlockUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/me", app.requireAuthenticatedUser(app.getCurrentUserInfoHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/me", app.requireAuthenticatedUser(app.editCurrentUserInfoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/me", app.requireAuthenticatedUser(app.deleteCurrentUserInfoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/export", app.requireAuthenticatedUser(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/me/2fa", app.requireActivatedUser(app.enrollTwoFactorHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/me/2fa/confirm", app.requireActivatedUser(app.confirmTwoFactorHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/me/2fa", app.requireActivatedUser(app.disableTwoFactorHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/serviceaccounts", app.requirePermission(data.PermissionUsersAdmin, app.createServiceAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/apikeys", app.requirePermission(data.PermissionUsersAdmin, app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/apikeys", app.requirePermission(data.PermissionUsersAdmin, app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/apikeys/:id", app.requirePermission(data.PermissionUsersAdmin, app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/healthcheck/ready", app.requirePermission(data.PermissionUsersAdmin, app.readinessDetailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/jobs", app.requirePermission(data.PermissionUsersAdmin, app.listJobsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/log-level", app.requirePermission(data.PermissionUsersAdmin, app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", app.requirePermission(data.PermissionUsersAdmin, app.updateLogLevelHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/mail", app.requirePermission(data.PermissionUsersAdmin, app.listMailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/mail/templates", app.requirePermission(data.PermissionUsersAdmin, app.listMailTemplatesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/mail/templates/:name", app.requirePermission(data.PermissionUsersAdmin, app.previewMailTemplateHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/mail/:id/requeue", app.requirePermission(data.PermissionUsersAdmin, app.requeueMailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/settings/2fa", app.requirePermission(data.PermissionUsersAdmin, app.showTwoFactorPolicyHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/settings/2fa", app.requirePermission(data.PermissionUsersAdmin, app.updateTwoFactorPolicyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission(data.PermissionUsersAdmin, app.expvarHandler))
+	router.HandlerFunc(http.MethodGet, "/metrics", app.requirePermission(data.PermissionUsersAdmin, app.prometheusHandler))
+
+	return app.recordMetrics(router, app.requestID(app.logAccess(router, app.recoverPanic(app.enableCORS(app.rateLimitIP(app.limiters.ip, app.authenticate(app.rateLimit(app.limiters.general, router.ServeHTTP))))))))
+}
+
+// metricsRoutes returns the handler for the internal metrics listener. It has no
+// authentication, so it must only be reachable from inside the network.
+func (app *application) metricsRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", app.expvarHandler)
+	mux.HandleFunc("/metrics", app.prometheusHandler)
+	return app.recoverPanic(mux)
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve starts the background jobs and the HTTP server, and blocks until the server
+// has shut down. On SIGINT or SIGTERM it stops accepting requests, waits for the ones
+// in flight and stops the jobs, all within the -shutdown-timeout deadline. Emails are
+// queued in the outbox rather than sent from goroutines, so there is nothing else to
+// wait for: anything still queued is delivered after the restart.
+func (app *application) serve() error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.routes(),
+		ErrorLog:     log.New(app.logger, "", 0),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	// The internal metrics listener is optional, and has no requests worth draining.
+	var metricsSrv *http.Server
+	if app.config.metricsAddr != "" {
+		metricsSrv = &http.Server{
+			Addr:         app.config.metricsAddr,
+			Handler:      app.metricsRoutes(),
+			ErrorLog:     log.New(app.logger, "", 0),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			app.logger.PrintInfo("starting metrics server", map[string]string{
+				"addr": metricsSrv.Addr,
+			})
+			err := metricsSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]string{"addr": metricsSrv.Addr})
+			}
+		}()
+	}
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	app.jobs.Start(jobsCtx)
+
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.PrintInfo("shutting down server", map[string]string{
+			"signal":  s.String(),
+			"timeout": app.config.shutdownTimeout.String(),
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		// Stop accepting new connections and wait for the requests in flight.
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+		app.logger.PrintInfo("requests drained", nil)
+
+		if metricsSrv != nil {
+			metricsSrv.Close()
+		}
+
+		// Tell the jobs to stop. A job in the middle of a run sees its context
+		// cancelled and returns early; the rest is picked up after the restart.
+		stopJobs()
+		err = waitContext(ctx, app.jobs.Wait)
+		if err != nil {
+			shutdownError <- fmt.Errorf("waiting for background jobs: %w", err)
+			return
+		}
+		app.logger.PrintInfo("background jobs stopped", nil)
+
+		shutdownError <- nil
+	}()
+
+	app.logger.PrintInfo("starting server", map[string]string{
+		"addr": srv.Addr,
+		"env":  app.config.env,
+	})
+
+	// ListenAndServe returns http.ErrServerClosed as soon as Shutdown is called, so
+	// that error means the graceful shutdown has started.
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("stopped server", map[string]string{
+		"addr": srv.Addr,
+	})
+	return nil
+}
+
+// waitContext calls wait and returns once it does, or with ctx's error if ctx is
+// done first.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,51 +1,71 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"gaproject.terminator8000.net/internal/data"
 	"gaproject.terminator8000.net/internal/validator"
+	"github.com/julienschmidt/httprouter"
 	"net/http"
 	"time"
 )
 
-func (app *application) expiredToken() {
-	fmt.Println("expiredToken started")
-	//ticker := time.NewTicker(10 * time.Second)
-	for {
-		//fmt.Println("")
-		users, err := app.models.UserInfo.GetForAllToken()
-		if err != nil {
-			fmt.Println("GetForAllToken error", err)
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
 
-			return
-		}
-		//fmt.Println("users", users)
-		for _, user := range users {
-			err = app.models.Tokens.DeleteExp(user.ID)
-			if err != nil {
-				fmt.Println("DeleteExp error")
-				return
-			}
+// resendExpiredActivationTokens replaces the expired activation tokens of users who
+// never activated their account, and emails them the new token. It runs as a
+// background job.
+func (app *application) resendExpiredActivationTokens(ctx context.Context) error {
+	users, err := app.models.UserInfo.GetForAllToken()
+	if err != nil {
+		return err
+	}
 
-			token, err := app.models.Tokens.New(user.ID, 5*time.Second, data.ScopeActivation)
-			if err != nil {
-				fmt.Println("Tokens.New error")
-				return
-			}
+	for _, user := range users {
+		// Stop early if the job has timed out or the server is shutting down. Users we
+		// didn't get to are picked up on the next run.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			data := map[string]any{
-				"activationToken": token.Plaintext,
-				"userID":          user.ID,
-			}
-			// Send the welcome email, passing in the map above as dynamic data.
-			err = app.mailer.Send(user.Email, "new_activation.tmpl", data)
-			if err != nil {
-				app.logger.PrintError(err, nil)
-			}
+		err = app.models.Transaction(func(tx data.TxModels) error {
+			return app.resendActivationToken(tx, &user, "new_activation.tmpl", "")
+		})
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
+// resendActivationToken replaces the user's activation token and queues an email
+// carrying the new one. Run it in a transaction, so that the token is never replaced
+// without the email being queued. requestID is empty when no request triggered it.
+func (app *application) resendActivationToken(tx data.TxModels, user *data.User, template, requestID string) error {
+	err := tx.Tokens.Delete(data.ScopeActivation, user.ID)
+	if err != nil {
+		return err
 	}
+
+	token, err := tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	return tx.Outbox.Insert(&data.Mail{
+		UserID:    user.ID,
+		Recipient: user.Email,
+		Locale:    user.Locale,
+		Template:  template,
+		RequestID: requestID,
+		Data: map[string]any{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		},
+	})
 }
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -67,11 +87,20 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	if !app.checkLockout(w, r, loginIPKey(app.clientIP(r))) {
+		return
+	}
+
 	// Lookup the user record based on the email address.
 	user, err := app.models.UserInfo.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.recordFailedLogin(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -79,30 +108,33 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// Check if user is already activated
-	if !user.Activated {
-		err := app.models.Tokens.Delete(data.ScopeActivation, user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
+	if !app.checkLockout(w, r, loginUserKey(user.ID)) {
+		return
+	}
+
+	// Service accounts only authenticate with API keys. They get the same response as
+	// a wrong password, so that this doesn't reveal which accounts are service ones.
+	if user.Role == data.RoleService {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	pendingDeletion, err := app.hasPendingDeletion(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// Check if user is already activated. Accounts waiting to be purged are
+	// deactivated too, but they go on to the password check below instead.
+	if !user.Activated && !pendingDeletion {
+		err := app.models.Transaction(func(tx data.TxModels) error {
+			return app.resendActivationToken(tx, user, "activation.tmpl", app.contextGetRequestID(r))
+		})
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		app.background(func() {
-			data := map[string]any{
-				"activationToken": token.Plaintext,
-				"userID":          user.ID,
-			}
-			// Send the welcome email, passing in the map above as dynamic data.
-			err = app.mailer.Send(user.Email, "activation.tmpl", data)
-			if err != nil {
-				app.logger.PrintError(err, nil)
-			}
-		})
 
 		// Respond with a message indicating account needs activation
 		err = app.writeJSON(w, http.StatusCreated, envelope{"message": "Account needs activation. Check your email for the link."}, nil)
@@ -122,20 +154,437 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
 	// helper again and return.
 	if !match {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	err = app.recordSuccessfulLogin(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Accounts waiting to be purged stay locked until the owner cancels the deletion
+	// with the token we emailed them. This is only reported once the password matches,
+	// so that it doesn't reveal the account to someone who only knows the email address.
+	if pendingDeletion {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	// Users with two-factor authentication get a short-lived pending token instead,
+	// which they exchange for real tokens at POST /v1/tokens/2fa.
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		pending, err := app.models.Tokens.New(user.ID, twoFactorPendingTokenTTL, data.Scope2FAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{
+			"2fa_pending_token": pending,
+			"message":           "two-factor authentication required, send your code to POST /v1/tokens/2fa",
+		}
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Otherwise, if the password is correct, we start a new token family and issue a
+	// short-lived access token together with a long-lived refresh token.
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.issueTokenPair(r, user, family)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// hasPendingDeletion reports whether the user's account is scheduled to be purged.
+func (app *application) hasPendingDeletion(userID int64) (bool, error) {
+	_, err := app.models.Deletions.Get(userID)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, data.ErrRecordNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// issueTokenPair creates a new authentication token and refresh token in the given
+// family and returns them ready to be written to the client. In signed token mode the
+// authentication token is a stateless signed token and isn't stored.
+func (app *application) issueTokenPair(r *http.Request, user *data.User, family string) (envelope, error) {
+	var accessToken *data.Token
+	var err error
+	if app.config.tokens.mode == "signed" {
+		accessToken, err = app.tokenKeys.Sign(user.ID, user.Role, family, accessTokenTTL)
+	} else {
+		accessToken, err = app.models.Tokens.NewSession(user.ID, accessTokenTTL, data.ScopeAuthentication, family, app.clientIP(r), r.UserAgent())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := app.models.Tokens.NewSession(user.ID, refreshTokenTTL, data.ScopeRefresh, family, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": accessToken, "refresh_token": refreshToken}, nil
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.GetForPlaintext(data.ScopeRefresh, input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A refresh token can only be used once. If it has already been rotated then
+	// either the client or an attacker is replaying a stolen token, and we can't tell
+	// which, so every token in the family is revoked and the user has to log in again.
+	rotated := false
+	if !token.Rotated {
+		rotated, err = app.models.Tokens.MarkRotated(token.Hash)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if !rotated {
+		err = app.models.Tokens.DeleteFamily(token.UserID, token.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.requestLogger(r).PrintWarnFields("refresh token reuse detected", map[string]any{
+			"user_id": token.UserID,
+			"ip":      app.clientIP(r),
+		})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.models.UserInfo.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The access token asserts that the account is active, so check again before
+	// issuing one. A deactivated account, or one waiting to be purged, loses the
+	// rest of its refresh chain.
+	pendingDeletion, err := app.hasPendingDeletion(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !user.Activated || pendingDeletion {
+		err = app.models.Tokens.DeleteFamily(user.ID, token.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if pendingDeletion {
+			app.accountPendingDeletionResponse(w, r)
+		} else {
+			app.inactiveAccountResponse(w, r)
+		}
+		return
+	}
+
+	env, err := app.issueTokenPair(r, user, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The same response is sent whether or not the email address belongs to an
+	// account, so that this endpoint can't be used to discover registered users.
+	env := envelope{"message": "if an account with that email address exists, you will receive an email containing password reset instructions"}
+
+	user, err := app.models.UserInfo.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Service accounts have no interactive login, so there is no password to reset.
+	if user.Role == data.RoleService {
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only the most recent reset token should be usable. The old token is only
+	// replaced once the email with the new one has been queued.
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		err := tx.Tokens.Delete(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err := tx.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.Mail{
+			UserID:    user.ID,
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "password_reset.tmpl",
+			RequestID: app.contextGetRequestID(r),
+			Data: map[string]any{
+				"passwordResetToken": token.Plaintext,
+			},
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// A signed token can't be revoked itself and stays valid until it expires, but
+	// revoking its family stops it from being refreshed.
+	if plaintext := app.contextGetToken(r); data.IsSignedToken(plaintext) {
+		claims, err := app.tokenKeys.Verify(plaintext)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		err = app.models.Tokens.DeleteFamily(claims.UserID, claims.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.Tokens.GetForPlaintext(data.ScopeAuthentication, app.contextGetToken(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Logging out also revokes the refresh token the access token was issued with.
+	if token.Family != "" {
+		err = app.models.Tokens.DeleteFamily(token.UserID, token.Family)
+	} else {
+		err = app.models.Tokens.DeleteForPlaintext(data.ScopeAuthentication, app.contextGetToken(r))
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.Delete(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.Delete(data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	current, err := app.currentTokenFamily(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, session := range sessions {
+		session.Current = current != "" && session.ID == current
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeSessionHandler logs one of the user's sessions out, by deleting every token
+// in its family. Signed access tokens already issued to it stay valid until they
+// expire, which takes at most accessTokenTTL.
+func (app *application) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	family := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	found := false
+	for _, session := range sessions {
+		if session.ID == family {
+			found = true
+			break
+		}
+	}
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteFamily(user.ID, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "the session has been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// currentTokenFamily returns the token family of the access token the request was
+// authenticated with, or an empty string for API keys and tokens without a family.
+func (app *application) currentTokenFamily(r *http.Request) (string, error) {
+	plaintext := app.contextGetToken(r)
+	if plaintext == "" {
+		return "", nil
+	}
+	if data.IsSignedToken(plaintext) {
+		claims, err := app.tokenKeys.Verify(plaintext)
+		if err != nil {
+			return "", err
+		}
+		return claims.Family, nil
+	}
+	token, err := app.models.Tokens.GetForPlaintext(data.ScopeAuthentication, plaintext)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return "", nil
+		}
+		return "", err
 	}
+	return token.Family, nil
 }
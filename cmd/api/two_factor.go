@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gaproject.terminator8000.net/internal/data"
+	"gaproject.terminator8000.net/internal/totp"
+	"gaproject.terminator8000.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+const (
+	twoFactorIssuer          = "GaProject"
+	twoFactorRecoveryCodes   = 10
+	twoFactorPendingTokenTTL = 5 * time.Minute
+)
+
+// verifySecondFactor accepts either a current TOTP code or one of the user's unused
+// recovery codes.
+func (app *application) verifySecondFactor(tf *data.TwoFactor, code string) (bool, error) {
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(tf.Secret, code, time.Now(), 1)
+		if !ok {
+			return false, nil
+		}
+		return app.models.TwoFactor.UseStep(tf.UserID, step)
+	}
+	return app.models.TwoFactor.UseRecoveryCode(tf.UserID, code)
+}
+
+func twoFactorKey(userID int64) string {
+	return fmt.Sprintf("2fa-user:%d", userID)
+}
+
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.UserInfo.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		v := validator.New()
+		v.AddError("2fa", "is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes(twoFactorRecoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enroll(user.ID, secret, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"otpauth_uri":    totp.URI(twoFactorIssuer, user.Email, secret),
+		"secret":         secret,
+		"recovery_codes": recoveryCodes,
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	v.Check(len(input.Code) == totp.Digits, "code", fmt.Sprintf("must be %d digits long", totp.Digits))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("2fa", "enrolment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if tf.Enabled {
+		v.AddError("2fa", "is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkLockout(w, r, twoFactorKey(user.ID)) {
+		return
+	}
+
+	ok, err := app.verifySecondFactor(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		_, err = app.recordFailedAttempt(twoFactorKey(user.ID), app.config.lockout.threshold)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.AddError("code", "is invalid or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Sessions which were started with only a password must not count as having
+	// passed a second factor, so they are revoked before 2FA is turned on. This
+	// request has just proved a code, so it gets a fresh session in their place.
+	// Signed access tokens can't be revoked and stay valid until they expire, but
+	// they can no longer be refreshed.
+	err = app.models.Tokens.Delete(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.Delete(data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// GetForToken doesn't load the role, which signed tokens need.
+	user, err = app.models.UserInfo.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.issueTokenPair(r, user, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env["message"] = "two-factor authentication enabled, other sessions have been logged out"
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkLockout(w, r, twoFactorKey(user.ID)) {
+		return
+	}
+
+	ok, err := app.verifySecondFactor(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		_, err = app.recordFailedAttempt(twoFactorKey(user.ID), app.config.lockout.threshold)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.AddError("code", "is invalid or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TwoFactor.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createTwoFactorTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.UserInfo.GetForToken(data.Scope2FAPending, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkLockout(w, r, twoFactorKey(user.ID)) {
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		_, err = app.recordFailedAttempt(twoFactorKey(user.ID), app.config.lockout.threshold)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.Delete(data.Scope2FAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Lockouts.Reset(twoFactorKey(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// GetForToken doesn't load the role, which signed tokens need.
+	user, err = app.models.UserInfo.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.issueTokenPair(r, user, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -14,6 +14,7 @@ func (app *application) createUserInfoHandler(w http.ResponseWriter, r *http.Req
 		Surname  string `json:"lname"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -22,11 +23,17 @@ func (app *application) createUserInfoHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Without an explicit choice, emails go out in the language the client asked for.
+	if input.Locale == "" {
+		input.Locale = app.preferredLocale(r)
+	}
+
 	user := &data.User{
 		Name:      input.Name,
 		Surname:   input.Surname,
 		Email:     input.Email,
-		Role:      "user",
+		Role:      data.RoleUser,
+		Locale:    input.Locale,
 		Activated: false,
 	}
 
@@ -42,7 +49,39 @@ func (app *application) createUserInfoHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.models.UserInfo.Insert(user)
+	// The user, their default permissions, their activation token and the welcome
+	// email are all written together, so a failure never leaves an account which
+	// can't be activated.
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		err := tx.UserInfo.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		// Every new account can read movies and module info by default. Anything more
+		// has to be granted explicitly.
+		err = tx.Permissions.AddForUser(user.ID, data.PermissionMoviesRead, data.PermissionModulesRead)
+		if err != nil {
+			return err
+		}
+
+		token, err := tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.Mail{
+			UserID:    user.ID,
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "user_welcome.tmpl",
+			RequestID: app.contextGetRequestID(r),
+			Data: map[string]any{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+			},
+		})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -53,23 +92,6 @@ func (app *application) createUserInfoHandler(w http.ResponseWriter, r *http.Req
 		}
 		return
 	}
-
-	token, err := app.models.Tokens.New(user.ID, 30*time.Second, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -83,6 +105,14 @@ func (app *application) getUserInfoHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.showUserInfo(w, r, id)
+}
+
+func (app *application) getCurrentUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	app.showUserInfo(w, r, app.contextGetUser(r).ID)
+}
+
+func (app *application) showUserInfo(w http.ResponseWriter, r *http.Request, id int64) {
 	user, err := app.models.UserInfo.Get(id)
 	if err != nil {
 		switch {
@@ -119,13 +149,23 @@ func (app *application) editUserInfoHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.editUserInfo(w, r, id)
+}
+
+func (app *application) editCurrentUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	app.editUserInfo(w, r, app.contextGetUser(r).ID)
+}
+
+func (app *application) editUserInfo(w http.ResponseWriter, r *http.Request, id int64) {
 	var input struct {
-		Name     string `json:"fname"`
-		Surname  string `json:"lname"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name            string `json:"fname"`
+		Surname         string `json:"lname"`
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+		Locale          string `json:"locale"`
 	}
-	err = app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -148,10 +188,38 @@ func (app *application) editUserInfoHandler(w http.ResponseWriter, r *http.Reque
 	if input.Surname != "" {
 		user.Surname = input.Surname
 	}
-	if input.Email != "" {
-		user.Email = input.Email
+	if input.Locale != "" {
+		user.Locale = input.Locale
+	}
+	// A new email address is only stored as pending. It replaces the current address
+	// once the user confirms it with the token we send to the new address.
+	emailChanged := input.Email != "" && input.Email != user.Email
+	if emailChanged {
+		user.PendingEmail = input.Email
 	}
 	if input.Password != "" {
+		// Users changing their own password must prove they know the current one, so
+		// that a stolen authentication token isn't enough to take over the account.
+		// Admins resetting somebody else's password are exempt.
+		if user.ID == app.contextGetUser(r).ID {
+			v := validator.New()
+			v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+			if !v.Valid() {
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+
+			match, err := user.Password.Matches(input.CurrentPassword)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if !match {
+				app.invalidCredentialsResponse(w, r)
+				return
+			}
+		}
+
 		err := user.Password.Set(input.Password)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
@@ -160,12 +228,41 @@ func (app *application) editUserInfoHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validator.New()
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+	if emailChanged {
+		data.ValidateEmail(v, user.PendingEmail)
+	}
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.UserInfo.Update(user)
+	if emailChanged {
+		_, err = app.models.UserInfo.GetByEmail(user.PendingEmail)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The pending address is only saved along with its tokens and emails, so a
+	// failure can't leave an email change which can never be confirmed.
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		err := tx.UserInfo.Update(user)
+		if err != nil {
+			return err
+		}
+
+		if emailChanged {
+			return app.startEmailChange(tx, r, user)
+		}
+		return nil
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -192,13 +289,93 @@ func (app *application) deleteUserInfoHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.models.UserInfo.Delete(id)
+	app.deleteUserInfo(w, r, id)
+}
+
+func (app *application) deleteCurrentUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	app.deleteUserInfo(w, r, app.contextGetUser(r).ID)
+}
+
+// deleteUserInfo doesn't delete the account straight away. It deactivates it and
+// schedules it to be purged once the grace period has passed, and emails the owner a
+// token they can use to cancel the deletion until then.
+func (app *application) deleteUserInfo(w http.ResponseWriter, r *http.Request, id int64) {
+	user, err := app.models.UserInfo.Get(id)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user_info successfully deleted"}, nil)
+	// Schedule the deletion, revoke the tokens and queue the cancel email together, so
+	// that a deletion is never scheduled without the email that lets the owner undo it.
+	var deletion *data.AccountDeletion
+	err = app.models.Transaction(func(tx data.TxModels) error {
+		var err error
+		deletion, err = tx.Deletions.Request(user.ID, app.config.deletion.gracePeriod)
+		if err != nil {
+			return err
+		}
+
+		user.Activated = false
+		err = tx.UserInfo.Update(user)
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopeRefresh, data.Scope2FAPending, data.ScopeDeletionCancel} {
+			err = tx.Tokens.Delete(scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		token, err := tx.Tokens.New(user.ID, time.Until(deletion.PurgeAfter), data.ScopeDeletionCancel)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Audit.Insert(&data.AuditEntry{
+			UserID:  user.ID,
+			ActorID: app.contextGetUser(r).ID,
+			Action:  data.AuditAccountDeletionRequested,
+			Details: map[string]string{"purge_after": deletion.PurgeAfter.Format(time.RFC3339)},
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.Mail{
+			UserID:    user.ID,
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "account_deletion.tmpl",
+			RequestID: app.contextGetRequestID(r),
+			Data: map[string]any{
+				"cancelToken": token.Plaintext,
+				"purgeAfter":  deletion.PurgeAfter.Format("2 January 2006"),
+			},
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"message":  "user_info scheduled for deletion",
+		"deletion": deletion,
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -221,10 +398,20 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	ipKey := activationIPKey(app.clientIP(r))
+	if !app.checkLockout(w, r, ipKey) {
+		return
+	}
+
 	user, err := app.models.UserInfo.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			_, err = app.recordFailedAttempt(ipKey, app.config.lockout.ipThreshold)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			v.AddError("token", "invalid or expired activation token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
@@ -257,3 +444,259 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.UserInfo.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.UserInfo.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The reset token is single use, and anyone still holding an authentication token
+	// issued under the old password must log in again.
+	err = app.models.Tokens.Delete(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.Delete(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.Delete(data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// startEmailChange sends a confirmation token to the user's pending email address and
+// a notice with a cancellation token to their current address, within tx.
+func (app *application) startEmailChange(tx data.TxModels, r *http.Request, user *data.User) error {
+	err := tx.Tokens.Delete(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		return err
+	}
+	err = tx.Tokens.Delete(data.ScopeEmailCancel, user.ID)
+	if err != nil {
+		return err
+	}
+
+	confirmToken, err := tx.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+	cancelToken, err := tx.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailCancel)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Outbox.Insert(&data.Mail{
+		UserID:    user.ID,
+		Recipient: user.PendingEmail,
+		Locale:    user.Locale,
+		Template:  "email_change_confirm.tmpl",
+		RequestID: app.contextGetRequestID(r),
+		Data: map[string]any{
+			"emailChangeToken": confirmToken.Plaintext,
+			"newEmail":         user.PendingEmail,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Outbox.Insert(&data.Mail{
+		UserID:    user.ID,
+		Recipient: user.Email,
+		Locale:    user.Locale,
+		Template:  "email_change_notice.tmpl",
+		RequestID: app.contextGetRequestID(r),
+		Data: map[string]any{
+			"cancelToken": cancelToken.Plaintext,
+			"newEmail":    user.PendingEmail,
+		},
+	})
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.UserInfo.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.PendingEmail == "" {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+
+	err = app.models.UserInfo.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.clearEmailChangeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// GetForToken doesn't load the role or the update time, so read the user again
+	// for the response.
+	user, err = app.models.UserInfo.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.UserInfo.GetForToken(data.ScopeEmailCancel, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired cancellation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.PendingEmail = ""
+
+	err = app.models.UserInfo.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.clearEmailChangeTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "the email change has been cancelled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) clearEmailChangeTokens(userID int64) error {
+	err := app.models.Tokens.Delete(data.ScopeEmailChange, userID)
+	if err != nil {
+		return err
+	}
+	return app.models.Tokens.Delete(data.ScopeEmailCancel, userID)
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// AccountDeletion is a pending request to delete a user's account. The account is
+// purged once PurgeAfter has passed, unless the request is cancelled first.
+type AccountDeletion struct {
+	UserID      int64     `json:"user_id"`
+	RequestedAt time.Time `json:"requested_at"`
+	PurgeAfter  time.Time `json:"purge_after"`
+}
+
+type AccountDeletionModel struct {
+	DB DBTX
+}
+
+// Request schedules the user's account for deletion after the grace period. Calling
+// it again for the same user keeps the original schedule.
+func (m AccountDeletionModel) Request(userID int64, gracePeriod time.Duration) (*AccountDeletion, error) {
+	query := `
+INSERT INTO account_deletions (user_id, purge_after)
+VALUES ($1, NOW() + make_interval(secs => $2))
+ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+RETURNING user_id, requested_at, purge_after`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deletion AccountDeletion
+	err := m.DB.QueryRowContext(ctx, query, userID, gracePeriod.Seconds()).Scan(&deletion.UserID, &deletion.RequestedAt, &deletion.PurgeAfter)
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// Get returns the pending deletion for a user, or ErrRecordNotFound if there is none.
+func (m AccountDeletionModel) Get(userID int64) (*AccountDeletion, error) {
+	query := `
+SELECT user_id, requested_at, purge_after
+FROM account_deletions
+WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deletion AccountDeletion
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&deletion.UserID, &deletion.RequestedAt, &deletion.PurgeAfter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &deletion, nil
+}
+
+// Cancel removes a pending deletion.
+func (m AccountDeletionModel) Cancel(userID int64) error {
+	query := `
+DELETE FROM account_deletions
+WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetDue returns the ids of all users whose grace period has ended.
+func (m AccountDeletionModel) GetDue() ([]int64, error) {
+	query := `
+SELECT user_id
+FROM account_deletions
+WHERE purge_after <= NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,219 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"gaproject.terminator8000.net/internal/validator"
+	"github.com/lib/pq"
+	"net"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix makes API keys easy to recognise, for example in secret scanners.
+const apiKeyPrefix = "gak_"
+
+// APIKey is a long-lived credential for a service account. Only a hash of the key is
+// stored; the plaintext is returned once, when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Prefix      string      `json:"prefix"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	AllowedIPs  []string    `json:"allowed_ips"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  time.Time   `json:"last_used_at"`
+}
+
+// AllowsIP reports whether the key may be used from the given client IP. A key with
+// an empty allowlist can be used from anywhere.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	clientIP := net.ParseIP(ip)
+	if clientIP == nil {
+		return false
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		if strings.Contains(allowed, "/") {
+			_, network, err := net.ParseCIDR(allowed)
+			if err == nil && network.Contains(clientIP) {
+				return true
+			}
+			continue
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(validator.PermittedValue(code, PermissionMoviesRead, PermissionMoviesWrite, PermissionModulesRead, PermissionModulesWrite, PermissionUsersAdmin), "permissions", "contains an unknown permission")
+	}
+	for _, allowed := range key.AllowedIPs {
+		_, _, cidrErr := net.ParseCIDR(allowed)
+		v.Check(cidrErr == nil || net.ParseIP(allowed) != nil, "allowed_ips", "must only contain IP addresses or CIDR ranges")
+	}
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(apiKeyPrefix)+52, "key", "must be a valid API key")
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// New generates a key for the given service account, stores its hash and returns it
+// with the plaintext filled in.
+func (m APIKeyModel) New(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+6]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	query := `
+INSERT INTO api_keys (hash, prefix, user_id, name, permissions, allowed_ips)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at, last_used_at`
+	args := []any{key.Hash, key.Prefix, key.UserID, key.Name, pq.Array(key.Permissions), pq.Array(key.AllowedIPs)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.LastUsedAt)
+}
+
+// GetForPlaintext looks up a key by its plaintext value.
+func (m APIKeyModel) GetForPlaintext(keyPlaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+SELECT id, prefix, user_id, name, permissions, allowed_ips, created_at, last_used_at
+FROM api_keys
+WHERE hash = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&key.ID,
+		&key.Prefix,
+		&key.UserID,
+		&key.Name,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.AllowedIPs),
+		&key.CreatedAt,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// GetAll returns every key, or only the keys for one user when userID is not zero.
+func (m APIKeyModel) GetAll(userID int64) ([]*APIKey, error) {
+	query := `
+SELECT id, prefix, user_id, name, permissions, allowed_ips, created_at, last_used_at
+FROM api_keys
+WHERE (user_id = $1 OR $1 = 0)
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.Prefix,
+			&key.UserID,
+			&key.Name,
+			pq.Array(&key.Permissions),
+			pq.Array(&key.AllowedIPs),
+			&key.CreatedAt,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Touch records that a key has just been used, at most once a minute.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE id = $1 AND last_used_at < NOW() - INTERVAL '1 minute'`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+func (m APIKeyModel) Delete(id int64) error {
+	query := `
+DELETE FROM api_keys
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditAccountExported          = "account.exported"
+	AuditAccountDeletionRequested = "account.deletion_requested"
+	AuditAccountDeletionCancelled = "account.deletion_cancelled"
+	AuditAccountPurged            = "account.purged"
+	AuditSettingChanged           = "setting.changed"
+)
+
+// AuditEntry records something that happened to a user's account. ActorID is the
+// user who did it, which is zero for background jobs.
+type AuditEntry struct {
+	ID        int64             `json:"id"`
+	UserID    int64             `json:"user_id"`
+	ActorID   int64             `json:"actor_id"`
+	Action    string            `json:"action"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB DBTX
+}
+
+func (m AuditModel) Insert(entry *AuditEntry) error {
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return err
+	}
+	if entry.Details == nil {
+		details = []byte("{}")
+	}
+
+	query := `
+INSERT INTO audit_log (user_id, actor_id, action, details)
+VALUES ($1, $2, $3, $4)
+RETURNING id, created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, entry.UserID, entry.ActorID, entry.Action, details).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAllForUser returns every audit entry about a user, oldest first.
+func (m AuditModel) GetAllForUser(userID int64) ([]*AuditEntry, error) {
+	query := `
+SELECT id, user_id, actor_id, action, details, created_at
+FROM audit_log
+WHERE user_id = $1
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var details []byte
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.ActorID, &entry.Action, &details, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(details, &entry.Details)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,35 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SchemaVersion is the migration version this build expects. Bump it with every new
+// migration.
+const SchemaVersion = 27
+
+type HealthModel struct {
+	DB *sql.DB
+}
+
+func (m HealthModel) Ping(ctx context.Context) error {
+	return m.DB.PingContext(ctx)
+}
+
+// MigrationVersion returns the version recorded by golang-migrate, and whether the
+// last migration failed halfway.
+func (m HealthModel) MigrationVersion(ctx context.Context) (int64, bool, error) {
+	query := `
+SELECT version, dirty
+FROM schema_migrations
+LIMIT 1`
+
+	var version int64
+	var dirty bool
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, dirty, nil
+}
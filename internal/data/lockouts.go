@@ -0,0 +1,134 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LockoutModel tracks failed authentication attempts. Each row is keyed by what was
+// being guessed at, for example "login-user:42" or "login-ip:203.0.113.7", so the
+// same table covers per-account and per-client limits.
+type LockoutModel struct {
+	DB *sql.DB
+}
+
+// Lockout is the failure count for a key, and when it stops being locked.
+type Lockout struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// Get returns the failure record for a key.
+func (m LockoutModel) Get(key string) (*Lockout, error) {
+	query := `
+SELECT key, failures, last_failure_at, locked_until
+FROM auth_failures
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockout Lockout
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&lockout.Key,
+		&lockout.Failures,
+		&lockout.LastFailureAt,
+		&lockout.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &lockout, nil
+}
+
+// RemainingLock returns how long the key stays locked for, or zero if it isn't locked.
+func (m LockoutModel) RemainingLock(key string) (time.Duration, error) {
+	query := `
+SELECT locked_until
+FROM auth_failures
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockedUntil time.Time
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	remaining := time.Until(lockedUntil)
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// RecordFailure counts a failed attempt against the key and returns the new number of
+// consecutive failures. Failures older than window are forgotten.
+func (m LockoutModel) RecordFailure(key string, window time.Duration) (int, error) {
+	query := `
+INSERT INTO auth_failures (key, failures, last_failure_at)
+VALUES ($1, 1, NOW())
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE
+        WHEN auth_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+        ELSE auth_failures.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING failures`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failures)
+	return failures, err
+}
+
+// Lock stops any further attempts against the key for the given duration.
+func (m LockoutModel) Lock(key string, duration time.Duration) error {
+	query := `
+UPDATE auth_failures
+SET locked_until = NOW() + make_interval(secs => $2)
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key, duration.Seconds())
+	return err
+}
+
+// Forgive takes one failure off the key's count, without lifting a lock which is
+// already in place.
+func (m LockoutModel) Forgive(key string) error {
+	query := `
+UPDATE auth_failures
+SET failures = GREATEST(failures - 1, 0)
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Reset clears all failures and any lock for the key.
+func (m LockoutModel) Reset(key string) error {
+	query := `
+DELETE FROM auth_failures
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
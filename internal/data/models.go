@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -10,26 +11,90 @@ var (
 	ErrRecordNotFound = errors.New("record (row, entry) not found")
 )
 
+// DBTX is the subset of *sql.DB and *sql.Tx used by the models, so that the same model
+// can run its queries either directly or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type Models struct {
+	db             *sql.DB
 	Movies         MovieModel
 	ModuleInfo     ModuleInfoModel
 	DepartmentInfo DepartmentInfoModel
-	//Permissions     PermissionModel // Add a new Permissions field.
+	Permissions    PermissionModel
+	Lockouts       LockoutModel
+	TwoFactor      TwoFactorModel
+	APIKeys        APIKeyModel
+	Deletions      AccountDeletionModel
+	Audit          AuditModel
+	Health         HealthModel
 	//Users  UsersModel
 	Tokens   TokenModel
 	UserInfo UserInfoModel
+	Outbox   OutboxModel
+	Settings SettingsModel
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
+		db:             db,
 		Movies:         MovieModel{DB: db},
 		ModuleInfo:     ModuleInfoModel{DB: db},
 		DepartmentInfo: DepartmentInfoModel{DB: db},
-		//Permissions:     PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
+		Permissions:    PermissionModel{DB: db},
+		Lockouts:       LockoutModel{DB: db},
+		TwoFactor:      TwoFactorModel{DB: db},
+		APIKeys:        APIKeyModel{DB: db},
+		Deletions:      AccountDeletionModel{DB: db},
+		Audit:          AuditModel{DB: db},
+		Health:         HealthModel{DB: db},
 		//Users:  UsersModel{DB: db},
 		Tokens:   TokenModel{DB: db},
 		UserInfo: UserInfoModel{DB: db},
+		Outbox:   OutboxModel{DB: db},
+		Settings: SettingsModel{DB: db},
+	}
+}
+
+// TxModels holds the models which can take part in a transaction.
+type TxModels struct {
+	Audit       AuditModel
+	Deletions   AccountDeletionModel
+	Permissions PermissionModel
+	Tokens      TokenModel
+	UserInfo    UserInfoModel
+	Outbox      OutboxModel
+	Settings    SettingsModel
+}
+
+// Transaction runs fn inside a database transaction. The transaction is committed if
+// fn returns nil, and rolled back otherwise.
+func (m Models) Transaction(fn func(tx TxModels) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(TxModels{
+		Audit:       AuditModel{DB: tx},
+		Deletions:   AccountDeletionModel{DB: tx},
+		Permissions: PermissionModel{DB: tx},
+		Tokens:      TokenModel{DB: tx},
+		UserInfo:    UserInfoModel{DB: tx},
+		Outbox:      OutboxModel{DB: tx},
+		Settings:    SettingsModel{DB: tx},
+	})
+	if err != nil {
+		return err
 	}
+	return tx.Commit()
 }
 
 type ModuleInfo struct {
@@ -0,0 +1,256 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	MailStatusPending = "pending"
+	MailStatusSent    = "sent"
+	MailStatusDead    = "dead"
+)
+
+// ErrMailRedacted is returned when requeueing a dead message whose one-time tokens
+// have already been discarded.
+var ErrMailRedacted = errors.New("mail data has been redacted")
+
+// MailSecretKeys are the template data keys which hold plaintext one-time tokens. They
+// are hidden from the admin API, and dropped from the outbox once a message is sent
+// or dead, so that the table and its backups never hold usable tokens for long.
+var MailSecretKeys = []string{"activationToken", "passwordResetToken", "emailChangeToken", "cancelToken"}
+
+// Mail is a message waiting in, or already delivered from, the outbox. UserID is the
+// account the message is about, so that its messages are removed with it. Data holds
+// the dynamic data for the template, and RequestID the ID of the API request which
+// queued the message, if any. Redacted is set once the tokens in Data have been
+// discarded.
+type Mail struct {
+	ID            int64          `json:"id"`
+	UserID        int64          `json:"user_id,omitempty"`
+	Recipient     string         `json:"recipient"`
+	Locale        string         `json:"locale"`
+	Template      string         `json:"template"`
+	Data          map[string]any `json:"data"`
+	RequestID     string         `json:"request_id,omitempty"`
+	Redacted      bool           `json:"redacted"`
+	Status        string         `json:"status"`
+	Attempts      int            `json:"attempts"`
+	LastError     string         `json:"last_error,omitempty"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+type OutboxModel struct {
+	DB DBTX
+}
+
+// Insert queues a message for delivery.
+func (m OutboxModel) Insert(mail *Mail) error {
+	data, err := json.Marshal(mail.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+INSERT INTO mail_outbox (user_id, recipient, locale, template, data, request_id)
+VALUES (NULLIF($1, 0), $2, $3, $4, $5, $6)
+RETURNING id, status, next_attempt_at, created_at, updated_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{mail.UserID, mail.Recipient, mail.Locale, mail.Template, data, mail.RequestID}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&mail.ID,
+		&mail.Status,
+		&mail.NextAttemptAt,
+		&mail.CreatedAt,
+		&mail.UpdatedAt,
+	)
+}
+
+// GetDue returns up to limit pending messages whose next attempt is due, oldest first.
+func (m OutboxModel) GetDue(limit int) ([]*Mail, error) {
+	query := `
+SELECT id, COALESCE(user_id, 0), recipient, locale, template, data, request_id, redacted, status, attempts, last_error, next_attempt_at, created_at, updated_at
+FROM mail_outbox
+WHERE status = $1 AND next_attempt_at <= NOW()
+ORDER BY id
+LIMIT $2`
+	return m.query(query, MailStatusPending, limit)
+}
+
+// GetAll returns messages with the given status, newest first.
+func (m OutboxModel) GetAll(status string, filters Filters) ([]*Mail, error) {
+	query := `
+SELECT id, COALESCE(user_id, 0), recipient, locale, template, data, request_id, redacted, status, attempts, last_error, next_attempt_at, created_at, updated_at
+FROM mail_outbox
+WHERE status = $1
+ORDER BY id DESC
+LIMIT $2 OFFSET $3`
+	return m.query(query, status, filters.PageSize, (filters.Page-1)*filters.PageSize)
+}
+
+// GetAllForUser returns the messages queued for a user, newest first.
+func (m OutboxModel) GetAllForUser(userID int64) ([]*Mail, error) {
+	query := `
+SELECT id, COALESCE(user_id, 0), recipient, locale, template, data, request_id, redacted, status, attempts, last_error, next_attempt_at, created_at, updated_at
+FROM mail_outbox
+WHERE user_id = $1
+ORDER BY id DESC`
+	return m.query(query, userID)
+}
+
+func (m OutboxModel) query(query string, args ...any) ([]*Mail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mails := []*Mail{}
+	for rows.Next() {
+		var mail Mail
+		var data []byte
+		err := rows.Scan(
+			&mail.ID,
+			&mail.UserID,
+			&mail.Recipient,
+			&mail.Locale,
+			&mail.Template,
+			&data,
+			&mail.RequestID,
+			&mail.Redacted,
+			&mail.Status,
+			&mail.Attempts,
+			&mail.LastError,
+			&mail.NextAttemptAt,
+			&mail.CreatedAt,
+			&mail.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Decode numbers as json.Number so that IDs render in templates exactly as
+		// they were queued, rather than as float64 values like 1e+06.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&mail.Data)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, &mail)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return mails, nil
+}
+
+// Redact replaces the one-time tokens in the message data, for display.
+func (mail *Mail) Redact() {
+	for _, key := range MailSecretKeys {
+		if _, ok := mail.Data[key]; ok {
+			mail.Data[key] = "[redacted]"
+		}
+	}
+}
+
+// MarkSent records a successful delivery, and clears the message data since it is no
+// longer needed.
+func (m OutboxModel) MarkSent(id int64) error {
+	query := `
+UPDATE mail_outbox
+SET status = $2, attempts = attempts + 1, last_error = '', data = '{}', redacted = true, updated_at = NOW()
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id, MailStatusSent)
+	return err
+}
+
+// MarkFailed records a failed delivery. The message is retried after retryAfter, or
+// moved to the dead-letter state if dead is true. A dead message keeps the rest of
+// its data for inspection, but its one-time tokens are dropped.
+func (m OutboxModel) MarkFailed(id int64, sendErr error, retryAfter time.Duration, dead bool) error {
+	status := MailStatusPending
+	if dead {
+		status = MailStatusDead
+	}
+
+	query := `
+UPDATE mail_outbox
+SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = NOW() + make_interval(secs => $4),
+    data = CASE WHEN $5 THEN data - $6::text[] ELSE data END,
+    redacted = redacted OR ($5 AND data ?| $6::text[]),
+    updated_at = NOW()
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id, status, sendErr.Error(), retryAfter.Seconds(), dead, pq.Array(MailSecretKeys))
+	return err
+}
+
+// Requeue moves a dead message back to pending with a fresh attempt count. Messages
+// whose tokens have been discarded can't be sent again, and return ErrMailRedacted;
+// the user has to ask for a new email instead.
+func (m OutboxModel) Requeue(id int64) error {
+	query := `
+UPDATE mail_outbox
+SET status = $2, attempts = 0, next_attempt_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND status = $3 AND NOT redacted`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, MailStatusPending, MailStatusDead)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		query = `
+SELECT redacted
+FROM mail_outbox
+WHERE id = $1 AND status = $2`
+		var redacted bool
+		err := m.DB.QueryRowContext(ctx, query, id, MailStatusDead).Scan(&redacted)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case err != nil:
+			return err
+		case redacted:
+			return ErrMailRedacted
+		}
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteFinished removes the sent and dead messages last updated more than age ago,
+// and returns how many were removed. Pending messages are kept however old they are.
+func (m OutboxModel) DeleteFinished(age time.Duration) (int64, error) {
+	query := `
+DELETE FROM mail_outbox
+WHERE status <> $1 AND updated_at < NOW() - make_interval(secs => $2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, MailStatusPending, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	PermissionMoviesRead   = "movies:read"
+	PermissionMoviesWrite  = "movies:write"
+	PermissionModulesRead  = "modules:read"
+	PermissionModulesWrite = "modules:write"
+	PermissionUsersAdmin   = "users:admin"
+)
+
+// Permissions holds the permission codes (like "movies:read") granted to a single user.
+type Permissions []string
+
+// Include checks whether the Permissions slice contains a specific permission code.
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type PermissionModel struct {
+	DB DBTX
+}
+
+// GetAllForUser returns all permission codes for a specific user.
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+SELECT permissions.code
+FROM permissions
+INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+INNER JOIN user_info ON users_permissions.user_id = user_info.id
+WHERE user_info.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// AddForUser grants the provided permission codes to a specific user. Codes the user
+// already holds are ignored.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	query := `
+INSERT INTO users_permissions
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
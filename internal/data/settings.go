@@ -0,0 +1,55 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SettingRequireAdminTwoFactor requires users with the users:admin permission to have
+// two-factor authentication enabled before they can use it.
+const SettingRequireAdminTwoFactor = "require_admin_2fa"
+
+// SettingsModel stores options which admins can change at runtime. They are kept in
+// the database so that every instance of the API sees the same value.
+type SettingsModel struct {
+	DB DBTX
+}
+
+// GetBool returns the value of a boolean setting, or ErrRecordNotFound if it has never
+// been set.
+func (m SettingsModel) GetBool(key string) (bool, error) {
+	query := `
+SELECT value
+FROM settings
+WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var value string
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&value)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+	return strconv.ParseBool(value)
+}
+
+// SetBool stores the value of a boolean setting.
+func (m SettingsModel) SetBool(key string, value bool) error {
+	query := `
+INSERT INTO settings (key, value)
+VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, strconv.FormatBool(value))
+	return err
+}
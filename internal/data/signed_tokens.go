@@ -0,0 +1,228 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	SigningAlgHS256 = "HS256"
+	SigningAlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidSignedToken = errors.New("invalid signed token")
+	ErrExpiredSignedToken = errors.New("expired signed token")
+)
+
+// Claims is the payload carried by a signed access token.
+type Claims struct {
+	UserID   int64  `json:"sub"`
+	Role     string `json:"role"`
+	Family   string `json:"fam,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+type signedTokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// SigningKey is a single named key which can sign and verify access tokens.
+type SigningKey struct {
+	ID      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// KeySet holds every key that signed tokens are accepted from. New tokens are always
+// signed with the active key, so keys can be rotated by adding a new key, making it
+// active, and removing the old one once the tokens it signed have expired.
+type KeySet struct {
+	active string
+	keys   map[string]SigningKey
+}
+
+// ParseKeySet builds a KeySet from a comma-separated list of "id:alg:key" entries,
+// where key is the base64-encoded HMAC secret or Ed25519 seed.
+func ParseKeySet(spec, activeKeyID string) (*KeySet, error) {
+	ks := &KeySet{
+		active: activeKeyID,
+		keys:   make(map[string]SigningKey),
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("signing key %q must have the form id:alg:key", entry)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", parts[0], err)
+		}
+
+		key := SigningKey{ID: parts[0], Alg: parts[1]}
+		switch key.Alg {
+		case SigningAlgHS256:
+			if len(raw) < 32 {
+				return nil, fmt.Errorf("signing key %q must be at least 32 bytes long", key.ID)
+			}
+			key.secret = raw
+		case SigningAlgEdDSA:
+			if len(raw) != ed25519.SeedSize {
+				return nil, fmt.Errorf("signing key %q must be a %d byte Ed25519 seed", key.ID, ed25519.SeedSize)
+			}
+			key.private = ed25519.NewKeyFromSeed(raw)
+			key.public = key.private.Public().(ed25519.PublicKey)
+		default:
+			return nil, fmt.Errorf("signing key %q has unsupported algorithm %q", key.ID, key.Alg)
+		}
+
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate signing key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+	if _, ok := ks.keys[ks.active]; !ok {
+		return nil, fmt.Errorf("active signing key %q is not in the key set", ks.active)
+	}
+	return ks, nil
+}
+
+// Sign issues a signed access token for the given user which expires after ttl.
+func (ks *KeySet) Sign(userID int64, role, family string, ttl time.Duration) (*Token, error) {
+	key := ks.keys[ks.active]
+	now := time.Now()
+
+	claims := Claims{
+		UserID:   userID,
+		Role:     role,
+		Family:   family,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(ttl).Unix(),
+	}
+
+	header, err := json.Marshal(signedTokenHeader{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	signature := key.sign([]byte(signingInput))
+
+	return &Token{
+		Plaintext: signingInput + "." + encodeSegment(signature),
+		UserID:    userID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     ScopeAuthentication,
+		Family:    family,
+	}, nil
+}
+
+// Verify checks the signature and expiry of a signed access token and returns its
+// claims. No database access is needed.
+func (ks *KeySet) Verify(tokenPlaintext string) (*Claims, error) {
+	parts := strings.Split(tokenPlaintext, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidSignedToken
+	}
+
+	headerJSON, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	var header signedTokenHeader
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+
+	// The algorithm comes from our own key, never from the token header, so a client
+	// can't downgrade the verification method.
+	key, ok := ks.keys[header.Kid]
+	if !ok || header.Alg != key.Alg {
+		return nil, ErrInvalidSignedToken
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidSignedToken
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+
+	if time.Now().Unix() >= claims.Expiry {
+		return nil, ErrExpiredSignedToken
+	}
+	return &claims, nil
+}
+
+func (k SigningKey) sign(message []byte) []byte {
+	switch k.Alg {
+	case SigningAlgEdDSA:
+		return ed25519.Sign(k.private, message)
+	default:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+}
+
+func (k SigningKey) verify(message, signature []byte) bool {
+	switch k.Alg {
+	case SigningAlgEdDSA:
+		return ed25519.Verify(k.public, message, signature)
+	default:
+		return hmac.Equal(k.sign(message), signature)
+	}
+}
+
+// IsSignedToken reports whether a token plaintext looks like a signed access token
+// rather than an opaque database token.
+func IsSignedToken(tokenPlaintext string) bool {
+	return strings.Count(tokenPlaintext, ".") == 2
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
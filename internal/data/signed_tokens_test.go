@@ -0,0 +1,163 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(b byte, n int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, n))
+}
+
+func TestParseKeySet(t *testing.T) {
+	hmacKey := testKey(1, 32)
+	edKey := testKey(2, 32)
+
+	tests := []struct {
+		name    string
+		spec    string
+		active  string
+		wantErr bool
+	}{
+		{"single HMAC key", "k1:HS256:" + hmacKey, "k1", false},
+		{"single Ed25519 key", "k1:EdDSA:" + edKey, "k1", false},
+		{"two keys with spaces", "k1:HS256:" + hmacKey + ", k2:EdDSA:" + edKey, "k2", false},
+		{"no keys", "", "k1", true},
+		{"missing part", "k1:HS256", "k1", true},
+		{"bad base64", "k1:HS256:!!!", "k1", true},
+		{"short HMAC secret", "k1:HS256:" + testKey(1, 16), "k1", true},
+		{"wrong Ed25519 seed size", "k1:EdDSA:" + testKey(2, 31), "k1", true},
+		{"unsupported algorithm", "k1:RS256:" + hmacKey, "k1", true},
+		{"duplicate id", "k1:HS256:" + hmacKey + ",k1:EdDSA:" + edKey, "k1", true},
+		{"unknown active key", "k1:HS256:" + hmacKey, "k2", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeySet(tt.spec, tt.active)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseKeySet error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeySetSignVerify(t *testing.T) {
+	for _, alg := range []string{SigningAlgHS256, SigningAlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			ks, err := ParseKeySet("k1:"+alg+":"+testKey(3, 32), "k1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := ks.Sign(42, RoleUser, "family", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsSignedToken(token.Plaintext) {
+				t.Errorf("%q isn't recognised as a signed token", token.Plaintext)
+			}
+
+			claims, err := ks.Verify(token.Plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.UserID != 42 || claims.Role != RoleUser || claims.Family != "family" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestKeySetVerifyRejects(t *testing.T) {
+	ks, err := ParseKeySet("k1:HS256:"+testKey(4, 32)+",k2:EdDSA:"+testKey(5, 32), "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ks.Sign(1, RoleUser, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token.Plaintext, ".")
+
+	expired, err := ks.Sign(1, RoleUser, "", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ParseKeySet("k1:HS256:"+testKey(6, 32), "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := other.Sign(1, RoleUser, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token which claims to be signed by the Ed25519 key, but carries the HMAC
+	// signature, must not be accepted.
+	swappedKid := encodeSegment([]byte(`{"alg":"HS256","typ":"JWT","kid":"k2"}`)) + "." + parts[1] + "." + parts[2]
+	noneAlg := encodeSegment([]byte(`{"alg":"none","typ":"JWT","kid":"k1"}`)) + "." + parts[1] + "."
+	tamperedClaims := parts[0] + "." + encodeSegment([]byte(`{"sub":2,"role":"admin","iat":0,"exp":9999999999}`)) + "." + parts[2]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"expired", expired.Plaintext, ErrExpiredSignedToken},
+		{"signed by another key set", foreign.Plaintext, ErrInvalidSignedToken},
+		{"key id swapped", swappedKid, ErrInvalidSignedToken},
+		{"alg none", noneAlg, ErrInvalidSignedToken},
+		{"tampered claims", tamperedClaims, ErrInvalidSignedToken},
+		{"two segments", parts[0] + "." + parts[1], ErrInvalidSignedToken},
+		{"bad encoding", parts[0] + "." + parts[1] + ".!!!", ErrInvalidSignedToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey := "k1:HS256:" + testKey(7, 32)
+	newKey := "k2:EdDSA:" + testKey(8, 32)
+
+	before, err := ParseKeySet(oldKey, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := before.Sign(1, RoleUser, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with the old key stay valid while it is still in the set...
+	during, err := ParseKeySet(oldKey+","+newKey, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = during.Verify(token.Plaintext)
+	if err != nil {
+		t.Errorf("old token rejected during rotation: %v", err)
+	}
+
+	// ...and are rejected once it has been removed.
+	after, err := ParseKeySet(newKey, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = after.Verify(token.Plaintext)
+	if !errors.Is(err, ErrInvalidSignedToken) {
+		t.Errorf("old token after rotation: error = %v, want %v", err, ErrInvalidSignedToken)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"gaproject.terminator8000.net/internal/validator"
 	"time"
 )
@@ -13,6 +15,12 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	Scope2FAPending     = "2fa-pending"
+	ScopeEmailChange    = "email-change"
+	ScopeEmailCancel    = "email-change-cancel"
+	ScopeDeletionCancel = "deletion-cancel"
 )
 
 type Token struct {
@@ -21,10 +29,28 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+	Family    string    `json:"-"`
+	Rotated   bool      `json:"-"`
+}
+
+// Session describes a login, which is a family of tokens rotated from the same
+// refresh token, without exposing the tokens themselves. ID is the family. Export
+// data uses the same type for individual tokens, with Scope set instead.
+type Session struct {
+	ID         string    `json:"id,omitempty"`
+	Scope      string    `json:"scope,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -47,6 +73,12 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
+	// Signed access tokens have no fixed length, so only sanity check their size.
+	// Their signature is checked separately by KeySet.Verify().
+	if IsSignedToken(tokenPlaintext) {
+		v.Check(len(tokenPlaintext) <= 4096, "token", "must not be more than 4096 bytes long")
+		return
+	}
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
@@ -59,11 +91,36 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewTokenFamily returns a random identifier which links a refresh token to every
+// token issued by rotating it.
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// NewSession works like New, but also records the token family and the client IP
+// address and user agent the token was issued to.
+func (m TokenModel) NewSession(userID int64, ttl time.Duration, scope, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-INSERT INTO tokens (hash, user_id, expiry, scope)
-VALUES ($1, $2, $3, $4)`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -80,6 +137,183 @@ WHERE scope = $1 AND user_id = $2`
 	return err
 }
 
+// DeleteForPlaintext deletes a single token with the given scope.
+func (m TokenModel) DeleteForPlaintext(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+DELETE FROM tokens
+WHERE hash = $1 AND scope = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	return err
+}
+
+// GetForPlaintext returns the unexpired token with the given scope and plaintext,
+// including tokens which have already been rotated.
+func (m TokenModel) GetForPlaintext(scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+SELECT hash, user_id, expiry, scope, family, rotated
+FROM tokens
+WHERE hash = $1 AND scope = $2 AND expiry > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var token Token
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Family,
+		&token.Rotated,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// MarkRotated flags a token as used. It returns false if the token had already been
+// rotated, which happens when two requests race to use the same token.
+func (m TokenModel) MarkRotated(hash []byte) (bool, error) {
+	query := `
+UPDATE tokens
+SET rotated = true
+WHERE hash = $1 AND rotated = false`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hash)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// DeleteFamily deletes every token belonging to a user's token family.
+func (m TokenModel) DeleteFamily(userID int64, family string) error {
+	query := `
+DELETE FROM tokens
+WHERE user_id = $1 AND family = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, family)
+	return err
+}
+
+// Touch records that a token has just been used. To keep this cheap on every request
+// the row is only written when the stored last_used_at is more than a minute old.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+UPDATE tokens
+SET last_used_at = NOW()
+WHERE hash = $1 AND last_used_at < NOW() - INTERVAL '1 minute'`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// GetSessionsForUser returns a user's logins, most recently used first. A login is
+// live as long as its family has an unrotated, unexpired refresh token; access tokens
+// are too short-lived to count, and signed ones aren't stored at all. CreatedAt and
+// LastUsedAt cover every token in the family.
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+SELECT t.family, f.created_at, f.last_used_at, t.expiry, t.ip, t.user_agent
+FROM tokens t
+JOIN (
+    SELECT family, MIN(created_at) AS created_at, MAX(last_used_at) AS last_used_at
+    FROM tokens
+    WHERE user_id = $2
+    GROUP BY family
+) f ON f.family = t.family
+WHERE t.scope = $1 AND t.user_id = $2 AND t.family <> '' AND NOT t.rotated AND t.expiry > NOW()
+ORDER BY f.last_used_at DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ScopeRefresh, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetMetadataForUser returns metadata for every token a user holds, in any scope.
+func (m TokenModel) GetMetadataForUser(userID int64) ([]*Session, error) {
+	query := `
+SELECT scope, created_at, last_used_at, expiry, ip, user_agent
+FROM tokens
+WHERE user_id = $1
+ORDER BY created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.Scope,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
 func (m TokenModel) DeleteExp(userID int64) error {
 	query := `
 DELETE FROM tokens
@@ -92,7 +326,7 @@ WHERE user_id = $1`
 
 func (m TokenModel) GetExp(userID int64, scope string) (*Token, error) {
 	query := `
-SELECT * FROM tokens
+SELECT hash, user_id, expiry, scope FROM tokens
 WHERE user_id = $1 AND scope = $2 AND expiry < NOW()`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// TwoFactor holds a user's TOTP enrolment. Enabled stays false until the user has
+// confirmed the enrolment with a first valid code.
+type TwoFactor struct {
+	UserID   int64
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the TOTP enrolment for a user, or ErrRecordNotFound if they have never
+// enrolled.
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+SELECT user_id, secret, enabled, last_step
+FROM user_totp
+WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.UserID, &tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &tf, nil
+}
+
+// IsEnabled reports whether the user has a confirmed TOTP enrolment.
+func (m TwoFactorModel) IsEnabled(userID int64) (bool, error) {
+	tf, err := m.Get(userID)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return tf.Enabled, nil
+}
+
+// Enroll stores a new, unconfirmed secret for the user together with a fresh set of
+// recovery codes, replacing any previous enrolment.
+func (m TwoFactorModel) Enroll(userID int64, secret string, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO user_totp (user_id, secret, enabled, last_step)
+VALUES ($1, $2, false, 0)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, enabled = false, last_step = 0, created_at = NOW()`
+	_, err = tx.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		hash := hashRecoveryCode(code)
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash[:], userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Enable marks a user's enrolment as confirmed.
+func (m TwoFactorModel) Enable(userID int64) error {
+	query := `
+UPDATE user_totp
+SET enabled = true
+WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Disable removes a user's enrolment and recovery codes.
+func (m TwoFactorModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseStep records the time step of an accepted code. It returns false if a code from
+// the same or a later step was already accepted, so that each code only works once.
+func (m TwoFactorModel) UseStep(userID, step int64) (bool, error) {
+	query := `
+UPDATE user_totp
+SET last_step = $2
+WHERE user_id = $1 AND last_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes. It returns false if the
+// code doesn't exist or has already been used.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	hash := hashRecoveryCode(code)
+
+	query := `
+DELETE FROM totp_recovery_codes
+WHERE hash = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hash[:], userID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// GenerateRecoveryCodes returns n random single-use codes in the form XXXXX-XXXXX.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) [32]byte {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return sha256.Sum256([]byte(normalized))
+}
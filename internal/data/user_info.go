@@ -15,19 +15,36 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// User roles. Service accounts are used by API keys and never log in with a password.
+const (
+	RoleUser    = "user"
+	RoleService = "service"
+)
+
+// Locales users can choose for the emails we send them.
+const (
+	LocaleEnglish = "en"
+	LocaleKazakh  = "kk"
+	LocaleRussian = "ru"
+)
+
+var Locales = []string{LocaleEnglish, LocaleKazakh, LocaleRussian}
+
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Name      string    `json:"fname"`
-	Surname   string    `json:"lname"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Role      string    `json:"user_role"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Name         string    `json:"fname"`
+	Surname      string    `json:"lname"`
+	Email        string    `json:"email"`
+	PendingEmail string    `json:"pending_email,omitempty"`
+	Password     password  `json:"-"`
+	Role         string    `json:"user_role"`
+	Locale       string    `json:"locale"`
+	Activated    bool      `json:"activated"`
+	Version      int       `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -40,7 +57,7 @@ type password struct {
 }
 
 type UserInfoModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func (p *password) Set(plaintextPassword string) error {
@@ -68,10 +85,10 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 
 func (m UserInfoModel) Insert(user *User) error {
 	query := `
-INSERT INTO user_info (fname, lname, email, password_hash, user_role, activated, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO user_info (fname, lname, email, password_hash, user_role, locale, activated, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 RETURNING id, created_at, version`
-	args := []any{user.Name, user.Surname, user.Email, user.Password.hash, user.Role, user.Activated, time.Now()}
+	args := []any{user.Name, user.Surname, user.Email, user.Password.hash, user.Role, user.Locale, user.Activated, time.Now()}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -89,7 +106,7 @@ RETURNING id, created_at, version`
 
 func (m UserInfoModel) Get(id int64) (*User, error) {
 	query := `
-SELECT id, created_at, updated_at, fname, lname, email, password_hash, user_role, activated, version
+SELECT id, created_at, updated_at, fname, lname, email, pending_email, password_hash, user_role, locale, activated, version
 FROM user_info
 WHERE id = $1`
 	var user User
@@ -102,8 +119,10 @@ WHERE id = $1`
 		&user.Name,
 		&user.Surname,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Role,
+		&user.Locale,
 		&user.Activated,
 		&user.Version,
 	)
@@ -118,7 +137,7 @@ WHERE id = $1`
 
 func (m UserInfoModel) GetAll() ([]*User, error) {
 	query := `
-SELECT id, created_at, updated_at, fname, lname, email, password_hash, user_role, activated, version
+SELECT id, created_at, updated_at, fname, lname, email, pending_email, password_hash, user_role, locale, activated, version
 FROM user_info`
 	var users []*User
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -139,8 +158,10 @@ FROM user_info`
 			&user.Name,
 			&user.Surname,
 			&user.Email,
+			&user.PendingEmail,
 			&user.Password.hash,
 			&user.Role,
+			&user.Locale,
 			&user.Activated,
 			&user.Version,
 		)
@@ -158,7 +179,7 @@ FROM user_info`
 
 func (m UserInfoModel) GetByEmail(email string) (*User, error) {
 	query := `
-SELECT id, created_at, updated_at, fname, lname, email, password_hash, user_role, activated, version
+SELECT id, created_at, updated_at, fname, lname, email, pending_email, password_hash, user_role, locale, activated, version
 FROM user_info
 WHERE email = $1`
 	var user User
@@ -171,8 +192,10 @@ WHERE email = $1`
 		&user.Name,
 		&user.Surname,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Role,
+		&user.Locale,
 		&user.Activated,
 		&user.Version,
 	)
@@ -190,14 +213,16 @@ WHERE email = $1`
 func (m UserInfoModel) Update(user *User) error {
 	query := `
 UPDATE user_info
-SET fname = $1, lname = $2, email = $3, password_hash = $4, activated = $5, updated_at = $6, version = version + 1
-WHERE id = $7 AND version = $8
+SET fname = $1, lname = $2, email = $3, pending_email = $4, password_hash = $5, locale = $6, activated = $7, updated_at = $8, version = version + 1
+WHERE id = $9 AND version = $10
 RETURNING version`
 	args := []any{
 		user.Name,
 		user.Surname,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
+		user.Locale,
 		user.Activated,
 		time.Now(),
 		user.ID,
@@ -227,10 +252,17 @@ func (m UserInfoModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
 	return nil
 }
 
@@ -238,7 +270,7 @@ func (m UserInfoModel) GetForToken(tokenScope, tokenPlaintext string) (*User, er
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-SELECT user_info.id, user_info.created_at, user_info.fname, user_info.lname, user_info.email, user_info.password_hash, user_info.activated, user_info.version
+SELECT user_info.id, user_info.created_at, user_info.fname, user_info.lname, user_info.email, user_info.pending_email, user_info.password_hash, user_info.locale, user_info.activated, user_info.version
 FROM user_info
 INNER JOIN tokens
 ON user_info.id = tokens.user_id
@@ -257,7 +289,9 @@ AND tokens.expiry > now()`
 		&user.Name,
 		&user.Surname,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
+		&user.Locale,
 		&user.Activated,
 		&user.Version,
 	)
@@ -274,18 +308,19 @@ AND tokens.expiry > now()`
 
 func (m UserInfoModel) GetForAllToken() ([]User, error) {
 	query := `
-SELECT user_info.id, user_info.created_at, user_info.fname, user_info.lname, user_info.email, user_info.password_hash, user_info.activated, user_info.version
+SELECT user_info.id, user_info.created_at, user_info.fname, user_info.lname, user_info.email, user_info.password_hash, user_info.locale, user_info.activated, user_info.version
 FROM user_info
 INNER JOIN tokens
 ON user_info.id = tokens.user_id
-WHERE  tokens.expiry < now() AND user_info.activated = false`
+WHERE  tokens.expiry < now() AND tokens.scope = $1 AND user_info.activated = false
+AND NOT EXISTS (SELECT 1 FROM account_deletions WHERE account_deletions.user_id = user_info.id)
+GROUP BY user_info.id`
 
-	//args := []any{}
 	var users []User
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, ScopeActivation)
 	if err != nil {
 		return nil, err
 	}
@@ -300,6 +335,7 @@ WHERE  tokens.expiry < now() AND user_info.activated = false`
 			&user.Surname,
 			&user.Email,
 			&user.Password.hash,
+			&user.Locale,
 			&user.Activated,
 			&user.Version,
 		)
@@ -330,6 +366,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 	v.Check(user.Surname != "", "name", "must be provided")
 	v.Check(len(user.Surname) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(validator.PermittedValue(user.Locale, Locales...), "locale", "must be one of en, kk or ru")
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 	// If the plaintext password is not nil, call the standalone
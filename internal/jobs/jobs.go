@@ -0,0 +1,297 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gaproject.terminator8000.net/internal/jsonlog"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historySize is the number of recent runs kept in memory for each job.
+const historySize = 20
+
+// Job describes a periodic piece of background work.
+type Job struct {
+	// Name identifies the job in logs and in the admin API. It is also used to derive
+	// the Postgres advisory lock key, so it must be unique.
+	Name string
+	// Interval is the time between the end of one run and the start of the next.
+	Interval time.Duration
+	// Jitter adds a random delay of up to this long before every run, so that API
+	// instances started together don't all hit the database at once.
+	Jitter time.Duration
+	// Timeout bounds a single run. The context passed to Run is cancelled once it
+	// expires.
+	Timeout time.Duration
+	// Local jobs only touch this instance's memory, so every instance runs them and
+	// they don't take the advisory lock.
+	Local bool
+	Run   func(ctx context.Context) error
+}
+
+// Run is the outcome of a single execution of a job.
+type Run struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Skipped   bool      `json:"skipped,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Status is a snapshot of a job's state, as shown by the admin API.
+type Status struct {
+	Name                string    `json:"name"`
+	Interval            string    `json:"interval"`
+	Running             bool      `json:"running"`
+	Runs                int64     `json:"runs"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastRunAt           time.Time `json:"last_run_at,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorAt         time.Time `json:"last_error_at,omitempty"`
+	NextRunAt           time.Time `json:"next_run_at"`
+	History             []Run     `json:"history"`
+}
+
+type entry struct {
+	job    Job
+	mu     sync.Mutex
+	status Status
+}
+
+// Scheduler runs a set of jobs, each in its own supervised goroutine. When a DB is
+// set, a Postgres advisory lock makes sure only one API instance runs a given job at
+// a time; the other instances record the run as skipped.
+type Scheduler struct {
+	db      *sql.DB
+	logger  *jsonlog.Logger
+	entries []*entry
+	wg      sync.WaitGroup
+}
+
+func New(db *sql.DB, logger *jsonlog.Logger) *Scheduler {
+	return &Scheduler{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Add registers a job. It must be called before Start.
+func (s *Scheduler) Add(job Job) {
+	s.entries = append(s.entries, &entry{
+		job: job,
+		status: Status{
+			Name:     job.Name,
+			Interval: job.Interval.String(),
+			History:  []Run{},
+		},
+	})
+}
+
+// Start launches every registered job. The jobs stop once ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, e := range s.entries {
+		s.wg.Add(1)
+		go func(e *entry) {
+			defer s.wg.Done()
+			s.supervise(ctx, e)
+		}(e)
+	}
+}
+
+// Wait blocks until every job goroutine has returned.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Statuses returns a snapshot of every job.
+func (s *Scheduler) Statuses() []Status {
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		e.mu.Lock()
+		status := e.status
+		status.History = append([]Run(nil), e.status.History...)
+		e.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Health returns an error naming every job which has failed maxFailures times in a
+// row, or which is stuck: either a run has gone on well past its timeout, or a run
+// is overdue and hasn't started. It returns nil if every job is healthy.
+func (s *Scheduler) Health(maxFailures int) error {
+	var problems []string
+	now := time.Now()
+
+	for _, e := range s.entries {
+		e.mu.Lock()
+		status := e.status
+		e.mu.Unlock()
+
+		// While a run is in progress, NextRunAt still holds the time it was due.
+		overdue := now.Sub(status.NextRunAt)
+		switch {
+		case status.ConsecutiveFailures >= maxFailures:
+			problems = append(problems, fmt.Sprintf("%s: %d consecutive failures, last: %s", e.job.Name, status.ConsecutiveFailures, status.LastError))
+		case status.Running && overdue > 2*e.job.Timeout:
+			problems = append(problems, fmt.Sprintf("%s: run due at %s is still running", e.job.Name, status.NextRunAt.Format(time.RFC3339)))
+		case !status.Running && !status.NextRunAt.IsZero() && overdue > e.job.Timeout:
+			problems = append(problems, fmt.Sprintf("%s: run due at %s has not started", e.job.Name, status.NextRunAt.Format(time.RFC3339)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// supervise runs a job until ctx is cancelled. A failed run doesn't stop the job; the
+// next attempt is delayed with exponential backoff, capped at the normal interval.
+func (s *Scheduler) supervise(ctx context.Context, e *entry) {
+	delay := jitter(e.job.Jitter)
+
+	for {
+		e.mu.Lock()
+		e.status.NextRunAt = time.Now().Add(delay)
+		e.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := s.runOnce(ctx, e)
+
+		e.mu.Lock()
+		failures := e.status.ConsecutiveFailures
+		e.mu.Unlock()
+
+		delay = e.job.Interval + jitter(e.job.Jitter)
+		if err != nil {
+			delay = backoff(failures, e.job.Interval)
+			s.logger.PrintError(err, map[string]string{
+				"job":   e.job.Name,
+				"retry": delay.String(),
+			})
+		}
+	}
+}
+
+// runOnce executes a single run of the job with its timeout, holding the job's
+// advisory lock and recovering from any panic.
+func (s *Scheduler) runOnce(ctx context.Context, e *entry) (err error) {
+	started := time.Now()
+	skipped := false
+
+	e.mu.Lock()
+	e.status.Running = true
+	e.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job %s panicked: %v", e.job.Name, p)
+		}
+		s.record(e, started, skipped, err)
+	}()
+
+	runCtx, cancel := context.WithTimeout(ctx, e.job.Timeout)
+	defer cancel()
+
+	if s.db == nil || e.job.Local {
+		return e.job.Run(runCtx)
+	}
+
+	conn, err := s.db.Conn(runCtx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := lockKey(e.job.Name)
+
+	var acquired bool
+	err = conn.QueryRowContext(runCtx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		skipped = true
+		return nil
+	}
+	defer func() {
+		// Use a fresh context, so the lock is released even if the run timed out.
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock($1)", key)
+	}()
+
+	return e.job.Run(runCtx)
+}
+
+func (s *Scheduler) record(e *entry, started time.Time, skipped bool, err error) {
+	run := Run{
+		StartedAt: started,
+		Duration:  time.Since(started).String(),
+		Skipped:   skipped,
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.status.Running = false
+	e.status.LastRunAt = started
+	if !skipped {
+		e.status.Runs++
+	}
+	if err != nil {
+		run.Error = err.Error()
+		e.status.Failures++
+		e.status.ConsecutiveFailures++
+		e.status.LastError = err.Error()
+		e.status.LastErrorAt = started
+	} else {
+		e.status.ConsecutiveFailures = 0
+	}
+
+	e.status.History = append(e.status.History, run)
+	if len(e.status.History) > historySize {
+		e.status.History = e.status.History[len(e.status.History)-historySize:]
+	}
+}
+
+// backoff returns the delay before retrying a job which has failed the given number of
+// times in a row. It starts at five seconds and doubles, but never exceeds interval.
+func backoff(failures int, interval time.Duration) time.Duration {
+	if failures > 20 {
+		failures = 20
+	}
+	delay := 5 * time.Second << (failures - 1)
+	if delay > interval || delay <= 0 {
+		delay = interval
+	}
+	return delay
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// lockKey derives a stable advisory lock key from a job name.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("jobs:" + name))
+	return int64(h.Sum64())
+}
@@ -2,10 +2,14 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,80 +19,253 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-// Define a custom Logger type. This holds the output destination that the log entries
-// will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// ParseLevel returns the level with the given name, ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// MarshalText and UnmarshalText let a Level appear by name in JSON and flag values.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// A Sink is an output destination for log entries. Each sink only receives entries
+// at or above its own MinLevel, on top of the logger's minimum level. The zero
+// MinLevel, LevelDebug, passes everything the logger writes.
+type Sink struct {
+	Out      io.Writer
+	MinLevel Level
+}
+
+// A LevelWriter is an output which wants to know the level of each entry, such as a
+// syslog writer which maps it to a severity. The logger calls WriteLevel instead of
+// Write on outputs which implement it.
+type LevelWriter interface {
+	WriteLevel(level Level, p []byte) (int, error)
+}
+
+// Define a custom Logger type. This holds the sinks that the log entries will be
+// written to, the minimum severity level that log entries will be written for, the
+// levels which get a stack trace, properties added to every entry, plus a mutex for
+// coordinating the writes. Everything but the properties is shared with the loggers
+// returned by With, so that they write to the same sinks and follow SetLevel and
+// SetTraceLevels on the parent.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	sinks       []Sink
+	minLevel    *atomic.Int32
+	traceLevels *atomic.Uint32
+	properties  map[string]any
+	mu          *sync.Mutex
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
+	return NewWithSinks(minLevel, Sink{Out: out})
+}
+
+// NewWithSinks returns a Logger which writes each log entry at or above minLevel to
+// every sink whose own minimum level it meets. Entries at the ERROR and FATAL levels
+// include a stack trace until SetTraceLevels says otherwise.
+func NewWithSinks(minLevel Level, sinks ...Sink) *Logger {
+	l := &Logger{
+		sinks:       sinks,
+		minLevel:    &atomic.Int32{},
+		traceLevels: &atomic.Uint32{},
+		mu:          &sync.Mutex{},
+	}
+	l.minLevel.Store(int32(minLevel))
+	l.SetTraceLevels(LevelError, LevelFatal)
+	return l
+}
+
+// Level returns the minimum severity level currently being written.
+func (l *Logger) Level() Level {
+	return Level(l.minLevel.Load())
+}
+
+// SetLevel changes the minimum severity level at runtime. The change applies to this
+// logger and every logger derived from it with With.
+func (l *Logger) SetLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+// SetTraceLevels sets the levels whose entries include a stack trace. Calling it with
+// no levels turns stack traces off.
+func (l *Logger) SetTraceLevels(levels ...Level) {
+	var mask uint32
+	for _, level := range levels {
+		mask |= 1 << uint(level)
+	}
+	l.traceLevels.Store(mask)
+}
+
+// Close closes every sink output which implements io.Closer, such as a rotating file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	for _, sink := range l.sinks {
+		if c, ok := sink.Out.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// With returns a logger which adds the given properties to every entry, on top of
+// any the logger already adds. Properties passed with an entry take precedence.
+func (l *Logger) With(properties map[string]string) *Logger {
+	return l.WithFields(fields(properties))
+}
+
+// WithFields is like With, but takes property values of any type.
+func (l *Logger) WithFields(properties map[string]any) *Logger {
+	merged := make(map[string]any, len(l.properties)+len(properties))
+	for k, v := range l.properties {
+		merged[k] = v
+	}
+	for k, v := range properties {
+		merged[k] = v
+	}
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		sinks:       l.sinks,
+		minLevel:    l.minLevel,
+		traceLevels: l.traceLevels,
+		properties:  merged,
+		mu:          l.mu,
 	}
 }
 
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, fields(properties))
+}
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+	l.print(LevelInfo, message, fields(properties))
+}
+func (l *Logger) PrintWarn(message string, properties map[string]string) {
+	l.print(LevelWarn, message, fields(properties))
 }
 func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+	l.print(LevelError, err.Error(), fields(properties))
 }
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
+	l.PrintFatalFields(err, fields(properties))
+}
+
+// The Fields variants take property values of any type, so that numbers and booleans
+// keep their JSON type. Durations are written as a number of milliseconds.
+func (l *Logger) PrintDebugFields(message string, properties map[string]any) {
+	l.print(LevelDebug, message, properties)
+}
+func (l *Logger) PrintInfoFields(message string, properties map[string]any) {
+	l.print(LevelInfo, message, properties)
+}
+func (l *Logger) PrintWarnFields(message string, properties map[string]any) {
+	l.print(LevelWarn, message, properties)
+}
+func (l *Logger) PrintErrorFields(err error, properties map[string]any) {
+	l.print(LevelError, err.Error(), properties)
+}
+func (l *Logger) PrintFatalFields(err error, properties map[string]any) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
+// fields converts string properties for the internal print method.
+func fields(properties map[string]string) map[string]any {
+	if properties == nil {
+		return nil
+	}
+	converted := make(map[string]any, len(properties))
+	for k, v := range properties {
+		converted[k] = v
+	}
+	return converted
+}
+
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, properties map[string]any) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if level < l.Level() {
 		return 0, nil
 	}
+	if len(l.properties) > 0 || hasDuration(properties) {
+		merged := make(map[string]any, len(l.properties)+len(properties))
+		for k, v := range l.properties {
+			merged[k] = v
+		}
+		for k, v := range properties {
+			merged[k] = v
+		}
+		properties = merged
+	}
+	for k, v := range properties {
+		if d, ok := v.(time.Duration); ok {
+			properties[k] = float64(d) / float64(time.Millisecond)
+		}
+	}
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
 		Properties: properties,
 	}
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
+	// Include a stack trace for entries at the levels set with SetTraceLevels.
+	if l.traceLevels.Load()&(1<<uint(level)) != 0 {
 		aux.Trace = string(debug.Stack())
 	}
 	// Declare a line variable for holding the actual log entry text.
@@ -100,13 +277,30 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	if err != nil {
 		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
 	}
-	// Lock the mutex so that no two writes to the output destination can happen
-	// concurrently. If we don't do this, it's possible that the text for two or more
-	// log entries will be intermingled in the output.
+	line = append(line, '\n')
+	// Lock the mutex so that no two writes to the same sink can happen concurrently.
+	// If we don't do this, it's possible that the text for two or more log entries
+	// will be intermingled in the output.
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	// Write the log entry followed by a newline.
-	return l.out.Write(append(line, '\n'))
+	// Write the log entry to every sink which accepts its level. A failing sink
+	// doesn't stop the entry reaching the others.
+	var errs []error
+	for _, sink := range l.sinks {
+		if level < sink.MinLevel {
+			continue
+		}
+		var err error
+		if lw, ok := sink.Out.(LevelWriter); ok {
+			_, err = lw.WriteLevel(level, line)
+		} else {
+			_, err = sink.Out.Write(line)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(line), errors.Join(errs...)
 }
 
 // We also implement a Write() method on our Logger type so that it satisfies the
@@ -115,3 +309,14 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// hasDuration reports whether any property is a time.Duration. The map is then copied
+// before durations are replaced, so that the caller's map is never modified.
+func hasDuration(properties map[string]any) bool {
+	for _, v := range properties {
+		if _, ok := v.(time.Duration); ok {
+			return true
+		}
+	}
+	return false
+}
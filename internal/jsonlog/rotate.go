@@ -0,0 +1,216 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files. It sorts in time order, which pruning relies on.
+const backupTimeFormat = "20060102T150405.000000000"
+
+// reopenInterval is how often a RotatingFile retries opening its file after a
+// rotation failed to, so that a full or unmounted disk isn't hit on every entry.
+const reopenInterval = time.Second
+
+// RotateOptions controls when a RotatingFile starts a new file and how many old ones
+// it keeps. A zero MaxSize or Interval disables that trigger, and a zero MaxBackups or
+// MaxAge keeps old files regardless of count or age.
+type RotateOptions struct {
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+// RotatingFile is an io.WriteCloser which appends to a file, and renames it with a
+// timestamp suffix once it reaches MaxSize bytes or a new Interval starts. Log entries
+// are never split between files.
+type RotatingFile struct {
+	path     string
+	opts     RotateOptions
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+	// openErr is why the file couldn't be reopened, and is returned by writes until
+	// the next attempt at retryAt.
+	openErr error
+	retryAt time.Time
+}
+
+// OpenRotatingFile opens, or creates, the file at path and its directory.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	if opts.MaxSize < 0 || opts.Interval < 0 || opts.MaxBackups < 0 || opts.MaxAge < 0 {
+		return nil, errors.New("jsonlog: rotate options must not be negative")
+	}
+	f := &RotatingFile{path: path, opts: opts}
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	// An existing file counts from when it was last written, so that a restart
+	// doesn't keep appending to a file from an earlier interval.
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		err := f.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// A failed rotation keeps writing to whichever file is open, so that entries are
+	// only lost if no file could be opened at all.
+	var rotateErr error
+	if f.due(int64(len(p))) {
+		rotateErr = f.rotate()
+		if f.file == nil {
+			f.openErr = rotateErr
+			f.retryAt = time.Now().Add(reopenInterval)
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// reopen retries opening the file after a failed rotation, at most once every
+// reopenInterval. Entries written in between are dropped.
+func (f *RotatingFile) reopen() error {
+	if time.Now().Before(f.retryAt) {
+		return f.openErr
+	}
+	err := f.open()
+	if err != nil {
+		f.openErr = err
+		f.retryAt = time.Now().Add(reopenInterval)
+		return err
+	}
+	f.openErr = nil
+	return nil
+}
+
+// due reports whether writing n more bytes should go to a new file. An empty file is
+// never rotated, so that an entry larger than MaxSize is still written.
+func (f *RotatingFile) due(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	if f.opts.Interval > 0 && !time.Now().Truncate(f.opts.Interval).Equal(f.openedAt.Truncate(f.opts.Interval)) {
+		return true
+	}
+	return false
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	renameErr := os.Rename(f.path, backup)
+	err = f.open()
+	if renameErr != nil || err != nil {
+		return errors.Join(renameErr, err)
+	}
+	return f.prune()
+}
+
+// prune removes the backups beyond MaxBackups, newest first, and any older than MaxAge.
+func (f *RotatingFile) prune() error {
+	if f.opts.MaxBackups == 0 && f.opts.MaxAge == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, prefix) {
+			_, err := time.Parse(backupTimeFormat, strings.TrimPrefix(name, prefix))
+			if err == nil {
+				backups = append(backups, name)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	var errs []error
+	cutoff := time.Now().Add(-f.opts.MaxAge)
+	for i, name := range backups {
+		remove := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		if !remove && f.opts.MaxAge > 0 {
+			created, _ := time.Parse(backupTimeFormat, strings.TrimPrefix(name, prefix))
+			remove = created.Before(cutoff)
+		}
+		if remove {
+			err := os.Remove(filepath.Join(filepath.Dir(f.path), name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("jsonlog: pruning old log files: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
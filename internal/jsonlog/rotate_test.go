@@ -0,0 +1,186 @@
+package jsonlog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logFiles returns the contents of the current log file followed by its backups,
+// oldest first.
+func logFiles(t *testing.T, path string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backups []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), filepath.Base(path)+".") {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	var contents []string
+	for _, name := range append([]string{filepath.Base(path)}, backups...) {
+		b, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   RotateOptions
+		writes []string
+		want   []string
+	}{
+		{
+			name:   "no limits",
+			writes: []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:   []string{"aaaa\nbbbb\ncccc\n"},
+		},
+		{
+			name:   "rotates before exceeding max size",
+			opts:   RotateOptions{MaxSize: 10},
+			writes: []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:   []string{"cccc\n", "aaaa\nbbbb\n"},
+		},
+		{
+			name:   "oversized entry on an empty file",
+			opts:   RotateOptions{MaxSize: 4},
+			writes: []string{"aaaaaaaa\n", "b\n"},
+			want:   []string{"b\n", "aaaaaaaa\n"},
+		},
+		{
+			name:   "keeps max backups",
+			opts:   RotateOptions{MaxSize: 5, MaxBackups: 2},
+			writes: []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"},
+			want:   []string{"dddd\n", "bbbb\n", "cccc\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs", "api.log")
+			f, err := OpenRotatingFile(path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			for _, w := range tt.writes {
+				n, err := f.Write([]byte(w))
+				if err != nil || n != len(w) {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+				// Backups are named to the nanosecond, but make sure they sort.
+				time.Sleep(time.Millisecond)
+			}
+
+			got := logFiles(t, path)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("files = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	err := os.WriteFile(path, []byte("old\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file last written in an earlier interval is rotated on the first write after
+	// a restart.
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(path, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, RotateOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("new\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := logFiles(t, path)
+	if strings.Join(got, "|") != "new\n|old\n" {
+		t.Errorf("files = %q", got)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "api.log")
+	f, err := OpenRotatingFile(path, RotateOptions{MaxSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("aaaa\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the directory gone the rotation can't reopen the file, and writes fail
+	// until the next retry is due.
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("bbbb\n"))
+	if err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	_, err = f.Write([]byte("cccc\n"))
+	if err == nil {
+		t.Fatal("expected the write before the retry to fail")
+	}
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.retryAt = time.Time{}
+	_, err = f.Write([]byte("dddd\n"))
+	if err != nil {
+		t.Fatalf("write after the retry: %v", err)
+	}
+	if got := logFiles(t, path); len(got) != 1 || got[0] != "dddd\n" {
+		t.Errorf("files = %q", got)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("eeee\n"))
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after Close: error = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestOpenRotatingFileNegativeOptions(t *testing.T) {
+	_, err := OpenRotatingFile(filepath.Join(t.TempDir(), "api.log"), RotateOptions{MaxSize: -1})
+	if err == nil {
+		t.Error("expected an error for a negative option")
+	}
+}
@@ -0,0 +1,81 @@
+package jsonlog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// syslogFacilityUser is the "user-level messages" facility from RFC 5424.
+const syslogFacilityUser = 1
+
+// SyslogWriter sends each log entry as one RFC 5424 message over UDP, which is what
+// local collectors such as rsyslog, syslog-ng and Vector listen for. The entry's
+// level sets the message severity. Delivery is fire-and-forget, so a collector which
+// is down doesn't slow the application.
+type SyslogWriter struct {
+	tag      string
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogWriter returns a SyslogWriter which sends to the collector at addr, such
+// as "127.0.0.1:514", with the given application name.
+func NewSyslogWriter(addr, tag string) (*SyslogWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if tag == "" {
+		tag = "-"
+	}
+	return &SyslogWriter{tag: tag, hostname: hostname, conn: conn}, nil
+}
+
+// Write sends p at the INFO severity, for callers which don't know the level.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(LevelInfo, p)
+}
+
+func (w *SyslogWriter) WriteLevel(level Level, p []byte) (int, error) {
+	priority := syslogFacilityUser*8 + syslogSeverity(level)
+	header := fmt.Sprintf("<%d>1 %s %s %s %d - - ",
+		priority, time.Now().UTC().Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid())
+	msg := append([]byte(header), bytes.TrimRight(p, "\n")...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *SyslogWriter) Close() error {
+	return w.conn.Close()
+}
+
+// syslogSeverity maps a level to its RFC 5424 severity code.
+func syslogSeverity(level Level) int {
+	switch level {
+	case LevelDebug:
+		return 7 // Debug.
+	case LevelInfo:
+		return 6 // Informational.
+	case LevelWarn:
+		return 4 // Warning.
+	case LevelError:
+		return 3 // Error.
+	default:
+		return 2 // Critical, for FATAL entries after which the application exits.
+	}
+}
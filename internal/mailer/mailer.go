@@ -2,64 +2,119 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
-	"github.com/go-mail/mail/v2"
 	"html/template"
-	"time"
+	"io/fs"
+	"strings"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// DefaultLocale is used for users whose locale has no translation of a template.
+const DefaultLocale = "en"
+
+// Message is a rendered email, ready to be handed to a Transport.
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+type Mailer struct {
+	transport Transport
+	sender    string
+}
 
+func New(transport Transport, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
+	}
+}
+
+// Ping checks that the transport can reach whatever it delivers to. Transports which
+// don't depend on anything outside the process always succeed.
+func (m Mailer) Ping(ctx context.Context) error {
+	if p, ok := m.transport.(Pinger); ok {
+		return p.Ping(ctx)
 	}
+	return nil
 }
 
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Send renders the template in the recipient's locale and hands the result to the
+// transport.
+func (m Mailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := Render(locale, templateFile, data)
 	if err != nil {
 		return err
 	}
 
+	msg.From = m.sender
+	msg.To = recipient
+	return m.transport.Send(msg)
+}
+
+// Render renders templates/<locale>/<templateFile> with the shared layout and the
+// locale's partials. If the template hasn't been translated into locale, the
+// DefaultLocale version is used instead. The returned message has no sender or
+// recipient.
+func Render(locale, templateFile string, data any) (*Message, error) {
+	tmpl, err := parseTemplate(resolveLocale(locale, templateFile), templateFile)
+	if err != nil {
+		return nil, err
+	}
+
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	return &Message{
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}, nil
+}
+
+func parseTemplate(locale, templateFile string) (*template.Template, error) {
+	return template.New("email").ParseFS(templateFS,
+		"templates/layout.tmpl",
+		"templates/"+locale+"/partials.tmpl",
+		"templates/"+locale+"/"+templateFile,
+	)
+}
+
+// resolveLocale returns the locale whose version of templateFile should be used.
+// Region subtags are ignored, so "ru-RU" uses the "ru" templates.
+func resolveLocale(locale, templateFile string) string {
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" || strings.ContainsAny(locale, "./") {
+		return DefaultLocale
+	}
 
-	err = m.dialer.DialAndSend(msg)
+	_, err := fs.Stat(templateFS, "templates/"+locale+"/"+templateFile)
 	if err != nil {
-		return err
+		return DefaultLocale
 	}
-	return nil
+	return locale
 }
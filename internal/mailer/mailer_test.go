@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		locale      string
+		wantSubject string
+	}{
+		{"default locale", "en", "Reset your GaProject password"},
+		{"translated locale", "ru", "Сброс пароля GaProject"},
+		{"region subtag", "ru-RU", "Сброс пароля GaProject"},
+		{"untranslated locale", "fr", "Reset your GaProject password"},
+		{"empty locale", "", "Reset your GaProject password"},
+		{"path in locale", "../en", "Reset your GaProject password"},
+	}
+
+	transport := NewMemoryTransport()
+	m := New(transport, "GaProject <no-reply@example.com>")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport.Reset()
+
+			err := m.Send("alice@example.com", tt.locale, "password_reset.tmpl", map[string]any{
+				"passwordResetToken": "TOKEN123",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msgs := transport.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(msgs))
+			}
+			msg := msgs[0]
+			if msg.To != "alice@example.com" || msg.From != "GaProject <no-reply@example.com>" {
+				t.Errorf("got To %q and From %q", msg.To, msg.From)
+			}
+			if msg.Subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", msg.Subject, tt.wantSubject)
+			}
+			if !strings.Contains(msg.PlainBody, "TOKEN123") || !strings.Contains(msg.HTMLBody, "TOKEN123") {
+				t.Error("token missing from the message body")
+			}
+		})
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	transport := NewMemoryTransport()
+	m := New(transport, "no-reply@example.com")
+
+	err := m.Send("alice@example.com", "en", "missing.tmpl", nil)
+	if err == nil {
+		t.Error("expected an error for a missing template")
+	}
+	if len(transport.Messages()) != 0 {
+		t.Error("a message was sent for a missing template")
+	}
+}
+
+// TestRenderAll renders every template in every locale, so that a broken translation
+// is caught before it is first sent.
+func TestRenderAll(t *testing.T) {
+	locales, err := fs.ReadDir(templateFS, "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		files, err := fs.ReadDir(templateFS, "templates/"+locale.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if file.Name() == "partials.tmpl" {
+				continue
+			}
+			t.Run(locale.Name()+"/"+file.Name(), func(t *testing.T) {
+				msg, err := Render(locale.Name(), file.Name(), map[string]any{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.TrimSpace(msg.Subject) == "" {
+					t.Error("empty subject")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// requiredBlocks are the templates every email must define, either itself or through
+// the shared layout.
+var requiredBlocks = []string{"subject", "plainBody", "htmlBody", "content"}
+
+// SampleData holds a value for every key used by the embedded templates, so that any
+// of them can be previewed.
+var SampleData = map[string]any{
+	"userID":             int64(12345),
+	"activationToken":    "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	"passwordResetToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	"emailChangeToken":   "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	"cancelToken":        "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	"newEmail":           "new.address@example.com",
+	"purgeAfter":         "1 January 2030",
+	"ip":                 "203.0.113.7",
+	"lockoutMinutes":     15,
+}
+
+// Locales returns the locales which have templates, in alphabetical order.
+func Locales() ([]string, error) {
+	entries, err := fs.ReadDir(templateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	var locales []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			locales = append(locales, entry.Name())
+		}
+	}
+	return locales, nil
+}
+
+// Templates returns the names of the email templates in a locale, in alphabetical
+// order. The locale's partials are not included.
+func Templates(locale string) ([]string, error) {
+	entries, err := fs.ReadDir(templateFS, path.Join("templates", locale))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && entry.Name() != "partials.tmpl" && strings.HasSuffix(entry.Name(), ".tmpl") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Check parses and renders every embedded template in every locale with SampleData.
+// It reports templates which are missing a required block, use a key that isn't in
+// SampleData, or have no DefaultLocale version to fall back to. All problems are
+// returned together.
+func Check() error {
+	locales, err := Locales()
+	if err != nil {
+		return err
+	}
+
+	defaults, err := Templates(DefaultLocale)
+	if err != nil {
+		return fmt.Errorf("default locale %q: %w", DefaultLocale, err)
+	}
+	known := make(map[string]bool)
+	for _, name := range defaults {
+		known[name] = true
+	}
+
+	var errs []error
+	for _, locale := range locales {
+		names, err := Templates(locale)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, name := range names {
+			if !known[name] {
+				errs = append(errs, fmt.Errorf("%s/%s: no %s version to fall back to", locale, name, DefaultLocale))
+			}
+			err := checkTemplate(locale, name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", locale, name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkTemplate(locale, name string) error {
+	tmpl, err := parseTemplate(locale, name)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range requiredBlocks {
+		if tmpl.Lookup(block) == nil {
+			return fmt.Errorf("missing %q block", block)
+		}
+	}
+
+	// Fail on unknown keys instead of rendering "<no value>", which is what a typo in
+	// a template would otherwise produce.
+	tmpl.Option("missingkey=error")
+	for _, block := range requiredBlocks {
+		err = tmpl.ExecuteTemplate(io.Discard, block, SampleData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"gaproject.terminator8000.net/internal/jsonlog"
+	"github.com/go-mail/mail/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport delivers a rendered message.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// Pinger is implemented by transports which depend on something outside the process,
+// so that health checks can tell whether it is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// TLS modes for the SMTP transport.
+const (
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "tls"
+	TLSModeNone     = "none"
+)
+
+// SMTPTransport sends messages through an SMTP server.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+// NewSMTPTransport returns an SMTP transport. With TLSModeStartTLS the server must
+// support STARTTLS, TLSModeImplicit connects over TLS from the start (usually port
+// 465), and TLSModeNone sends in plain text, which is only suitable for a local relay.
+func NewSMTPTransport(host string, port int, username, password, tlsMode string) (*SMTPTransport, error) {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	switch tlsMode {
+	case TLSModeStartTLS:
+		dialer.StartTLSPolicy = mail.MandatoryStartTLS
+	case TLSModeImplicit:
+		dialer.SSL = true
+	case TLSModeNone:
+		dialer.StartTLSPolicy = mail.NoStartTLS
+	default:
+		return nil, fmt.Errorf("invalid SMTP TLS mode %q", tlsMode)
+	}
+
+	return &SMTPTransport{dialer: dialer}, nil
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(msg.mime())
+}
+
+// Ping checks that the SMTP server accepts TCP connections. It doesn't log in, so
+// that frequent health checks don't trip the server's own rate limits.
+func (t *SMTPTransport) Ping(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(t.dialer.Host, strconv.Itoa(t.dialer.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// FileTransport writes every message to its own .eml file in a directory, where it
+// can be opened with any mail client.
+type FileTransport struct {
+	dir string
+}
+
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransport{dir: dir}, nil
+}
+
+// Ping checks that the directory still exists.
+func (t *FileTransport) Ping(ctx context.Context) error {
+	info, err := os.Stat(t.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", t.dir)
+	}
+	return nil
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	f, err := os.OpenFile(filepath.Join(t.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mime().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MemoryTransport keeps every message in memory, so tests can inspect what was sent.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message(nil), t.messages...)
+}
+
+// Reset discards the captured messages.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
+
+// LogTransport doesn't deliver anything. It logs the recipient and subject of each
+// message instead.
+type LogTransport struct {
+	logger *jsonlog.Logger
+}
+
+func NewLogTransport(logger *jsonlog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Send(msg *Message) error {
+	t.logger.PrintInfo("email not sent (log transport)", map[string]string{
+		"to":      msg.To,
+		"subject": msg.Subject,
+	})
+	return nil
+}
+
+func (msg *Message) mime() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+	return m
+}
@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the request duration histogram
+// buckets.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets with fixed upper bounds.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// HistogramSnapshot is a point-in-time copy of a Histogram. Counts are cumulative,
+// as in the Prometheus format: Counts[i] is the number of observations less than or
+// equal to Bounds[i].
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += v
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.buckets) {
+		h.buckets[i]++
+	}
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.buckets)),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	var cumulative uint64
+	for i, n := range h.buckets {
+		cumulative += n
+		s.Counts[i] = cumulative
+	}
+	return s
+}
+
+type gauge struct {
+	help string
+	fn   func() float64
+}
+
+// Registry collects the HTTP, database and runtime metrics of the API.
+type Registry struct {
+	version string
+	db      *sql.DB
+
+	mu        sync.Mutex
+	requests  uint64
+	inFlight  int64
+	responses map[int]uint64
+	durations map[string]*Histogram
+	gauges    map[string]gauge
+}
+
+func New(version string, db *sql.DB) *Registry {
+	return &Registry{
+		version:   version,
+		db:        db,
+		responses: make(map[int]uint64),
+		durations: make(map[string]*Histogram),
+		gauges:    make(map[string]gauge),
+	}
+}
+
+// AddGauge registers a value which is read every time the metrics are exported.
+func (m *Registry) AddGauge(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = gauge{help: help, fn: fn}
+}
+
+// RequestStarted counts a request as received and in flight.
+func (m *Registry) RequestStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	m.inFlight++
+}
+
+// RequestFinished records the response to a request. route is the route pattern,
+// such as "GET /v1/movies/:id", rather than the path, so that the number of
+// histograms stays bounded.
+func (m *Registry) RequestFinished(route string, status int, duration time.Duration) {
+	m.mu.Lock()
+	m.inFlight--
+	m.responses[status]++
+	h, ok := m.durations[route]
+	if !ok {
+		h = NewHistogram(DefaultBuckets)
+		m.durations[route] = h
+	}
+	m.mu.Unlock()
+
+	h.Observe(duration.Seconds())
+}
+
+// Snapshot is a point-in-time copy of every metric.
+type Snapshot struct {
+	Version    string                       `json:"version"`
+	Goroutines int                          `json:"goroutines"`
+	Requests   uint64                       `json:"total_requests_received"`
+	InFlight   int64                        `json:"requests_in_flight"`
+	Responses  map[int]uint64               `json:"total_responses_sent_by_status"`
+	Durations  map[string]HistogramSnapshot `json:"request_duration_seconds"`
+	Database   *sql.DBStats                 `json:"database,omitempty"`
+	Gauges     map[string]float64           `json:"gauges"`
+}
+
+func (m *Registry) Snapshot() Snapshot {
+	m.mu.Lock()
+	s := Snapshot{
+		Version:    m.version,
+		Goroutines: runtime.NumGoroutine(),
+		Requests:   m.requests,
+		InFlight:   m.inFlight,
+		Responses:  make(map[int]uint64, len(m.responses)),
+		Durations:  make(map[string]HistogramSnapshot, len(m.durations)),
+		Gauges:     make(map[string]float64, len(m.gauges)),
+	}
+	for status, n := range m.responses {
+		s.Responses[status] = n
+	}
+	histograms := make(map[string]*Histogram, len(m.durations))
+	for route, h := range m.durations {
+		histograms[route] = h
+	}
+	gauges := make(map[string]gauge, len(m.gauges))
+	for name, g := range m.gauges {
+		gauges[name] = g
+	}
+	m.mu.Unlock()
+
+	// Read the histograms and gauges outside the registry lock, since gauges may
+	// take locks of their own.
+	for route, h := range histograms {
+		s.Durations[route] = h.Snapshot()
+	}
+	for name, g := range gauges {
+		s.Gauges[name] = g.fn()
+	}
+	if m.db != nil {
+		stats := m.db.Stats()
+		s.Database = &stats
+	}
+	return s
+}
+
+// Publish exposes the metrics as expvar variables, so that they are included in the
+// JSON served by expvar. It must only be called once per process.
+func (m *Registry) Publish() {
+	expvar.Publish("version", expvar.Func(func() any { return m.version }))
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("timestamp", expvar.Func(func() any { return time.Now().Unix() }))
+	expvar.Publish("http", expvar.Func(func() any {
+		s := m.Snapshot()
+		return map[string]any{
+			"total_requests_received":        s.Requests,
+			"requests_in_flight":             s.InFlight,
+			"total_responses_sent_by_status": s.Responses,
+			"request_duration_seconds":       s.Durations,
+		}
+	}))
+	expvar.Publish("database", expvar.Func(func() any {
+		if m.db == nil {
+			return nil
+		}
+		return m.db.Stats()
+	}))
+	expvar.Publish("gauges", expvar.Func(func() any { return m.Snapshot().Gauges }))
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *Registry) WritePrometheus(w io.Writer) error {
+	s := m.Snapshot()
+	p := &promWriter{w: w}
+
+	p.header("api_build_info", "gauge", "Build information.")
+	p.sample("api_build_info", fmt.Sprintf(`{version=%q}`, s.Version), 1)
+
+	p.header("api_goroutines", "gauge", "Number of goroutines.")
+	p.sample("api_goroutines", "", float64(s.Goroutines))
+
+	p.header("api_http_requests_total", "counter", "Total HTTP requests received.")
+	p.sample("api_http_requests_total", "", float64(s.Requests))
+
+	p.header("api_http_requests_in_flight", "gauge", "HTTP requests currently being served.")
+	p.sample("api_http_requests_in_flight", "", float64(s.InFlight))
+
+	p.header("api_http_responses_total", "counter", "Total HTTP responses sent, by status code.")
+	for _, status := range sortedInts(s.Responses) {
+		p.sample("api_http_responses_total", fmt.Sprintf(`{code="%d"}`, status), float64(s.Responses[status]))
+	}
+
+	p.header("api_http_request_duration_seconds", "histogram", "HTTP request latency, by route.")
+	for _, route := range sortedKeys(s.Durations) {
+		h := s.Durations[route]
+		label := fmt.Sprintf(`route=%q`, route)
+		for i, bound := range h.Bounds {
+			p.sample("api_http_request_duration_seconds_bucket", fmt.Sprintf(`{%s,le="%s"}`, label, formatFloat(bound)), float64(h.Counts[i]))
+		}
+		p.sample("api_http_request_duration_seconds_bucket", fmt.Sprintf(`{%s,le="+Inf"}`, label), float64(h.Count))
+		p.sample("api_http_request_duration_seconds_sum", "{"+label+"}", h.Sum)
+		p.sample("api_http_request_duration_seconds_count", "{"+label+"}", float64(h.Count))
+	}
+
+	if db := s.Database; db != nil {
+		p.header("api_db_max_open_connections", "gauge", "Maximum number of open database connections.")
+		p.sample("api_db_max_open_connections", "", float64(db.MaxOpenConnections))
+		p.header("api_db_open_connections", "gauge", "Open database connections.")
+		p.sample("api_db_open_connections", "", float64(db.OpenConnections))
+		p.header("api_db_in_use_connections", "gauge", "Database connections in use.")
+		p.sample("api_db_in_use_connections", "", float64(db.InUse))
+		p.header("api_db_idle_connections", "gauge", "Idle database connections.")
+		p.sample("api_db_idle_connections", "", float64(db.Idle))
+		p.header("api_db_wait_count_total", "counter", "Total number of waits for a database connection.")
+		p.sample("api_db_wait_count_total", "", float64(db.WaitCount))
+		p.header("api_db_wait_duration_seconds_total", "counter", "Total time spent waiting for a database connection.")
+		p.sample("api_db_wait_duration_seconds_total", "", db.WaitDuration.Seconds())
+		p.header("api_db_max_idle_time_closed_total", "counter", "Connections closed because of the max idle time.")
+		p.sample("api_db_max_idle_time_closed_total", "", float64(db.MaxIdleTimeClosed))
+	}
+
+	for _, name := range sortedKeys(s.Gauges) {
+		m.mu.Lock()
+		help := m.gauges[name].help
+		m.mu.Unlock()
+		p.header("api_"+name, "gauge", help)
+		p.sample("api_"+name, "", s.Gauges[name])
+	}
+
+	return p.err
+}
+
+// promWriter writes lines until the first error, which it keeps.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) sample(name, labels string, value float64) {
+	p.printf("%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format, args...)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedInts[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per key. Every bucket holds up to Burst
+// tokens and refills at Rate tokens per second; each request takes one token.
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Result describes the state of a bucket after a call to Allow.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size.
+	Limit int
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next token is available. It is zero when a
+	// token is available now.
+	RetryAfter time.Duration
+}
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key, if there is one.
+func (l *Limiter) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	// Refill for the time since the bucket was last used.
+	b.tokens += now.Sub(b.lastSeen).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.lastSeen = now
+
+	result := Result{Limit: l.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(1 - b.tokens)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = l.duration(float64(l.Burst) - b.tokens)
+	return result
+}
+
+// Cleanup removes the buckets which have refilled completely since they were last
+// used, and returns how many it removed. A full bucket is indistinguishable from a
+// new one, so forgetting it doesn't change any client's limit.
+func (l *Limiter) Cleanup() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	removed := 0
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= l.duration(float64(l.Burst)-b.tokens) {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of buckets being tracked.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// duration returns how long it takes to refill the given number of tokens.
+func (l *Limiter) duration(tokens float64) time.Duration {
+	if tokens <= 0 || l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
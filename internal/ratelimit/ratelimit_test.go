@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time source which only moves when told to.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(rate float64, burst int) (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := New(rate, burst)
+	l.now = c.now
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		advance       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantRetry     time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst then refused",
+			rate:  1,
+			burst: 3,
+			steps: []step{
+				{0, true, 2, 0},
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, time.Second},
+			},
+		},
+		{
+			name:  "refills over time",
+			rate:  2,
+			burst: 2,
+			steps: []step{
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{250 * time.Millisecond, false, 0, 250 * time.Millisecond},
+				{250 * time.Millisecond, true, 0, 0},
+			},
+		},
+		{
+			name:  "never refills past the burst",
+			rate:  10,
+			burst: 2,
+			steps: []step{
+				{0, true, 1, 0},
+				{time.Hour, true, 1, 0},
+				{0, true, 0, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, c := newTestLimiter(tt.rate, tt.burst)
+			for i, s := range tt.steps {
+				c.advance(s.advance)
+				res := l.Allow("key")
+				if res.Allowed != s.wantAllowed || res.Remaining != s.wantRemaining || res.RetryAfter != s.wantRetry {
+					t.Errorf("step %d: got allowed=%t remaining=%d retry=%s, want allowed=%t remaining=%d retry=%s",
+						i, res.Allowed, res.Remaining, res.RetryAfter, s.wantAllowed, s.wantRemaining, s.wantRetry)
+				}
+				if res.Limit != tt.burst {
+					t.Errorf("step %d: limit = %d, want %d", i, res.Limit, tt.burst)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowSeparateKeys(t *testing.T) {
+	l, _ := newTestLimiter(1, 1)
+	if !l.Allow("a").Allowed {
+		t.Fatal("first request for a was refused")
+	}
+	if l.Allow("a").Allowed {
+		t.Error("second request for a was allowed")
+	}
+	if !l.Allow("b").Allowed {
+		t.Error("b shares a's bucket")
+	}
+}
+
+func TestReset(t *testing.T) {
+	l, _ := newTestLimiter(2, 4)
+	l.Allow("key")
+	res := l.Allow("key")
+	// Two tokens are missing, which take a second to refill at 2 per second.
+	if res.Reset != time.Second {
+		t.Errorf("reset = %s, want 1s", res.Reset)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l, c := newTestLimiter(1, 2)
+	l.Allow("idle")
+	l.Allow("busy")
+	l.Allow("busy")
+
+	c.advance(time.Second)
+	if n := l.Cleanup(); n != 1 {
+		t.Errorf("first cleanup removed %d buckets, want 1", n)
+	}
+	if l.Len() != 1 {
+		t.Errorf("%d buckets left, want 1", l.Len())
+	}
+
+	c.advance(time.Second)
+	if n := l.Cleanup(); n != 1 {
+		t.Errorf("second cleanup removed %d buckets, want 1", n)
+	}
+	if l.Len() != 0 {
+		t.Errorf("%d buckets left, want 0", l.Len())
+	}
+}
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    id bigserial PRIMARY KEY,
+    code text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES user_info ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:read'),
+    ('movies:write'),
+    ('modules:write'),
+    ('users:admin');
+
+-- Accounts created before permissions existed could read movies, so keep it that way.
+INSERT INTO users_permissions
+SELECT u.id, p.id FROM user_info u, permissions p WHERE p.code = 'movies:read'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE user_info
+    ADD COLUMN IF NOT EXISTS pending_email citext NOT NULL DEFAULT '';
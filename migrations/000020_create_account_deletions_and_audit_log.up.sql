@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS account_deletions (
+    user_id bigint PRIMARY KEY REFERENCES user_info ON DELETE CASCADE,
+    requested_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    purge_after timestamp(0) with time zone NOT NULL
+);
+
+-- audit_log deliberately has no foreign key to user_info, so that the entries
+-- outlive the accounts they describe.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    actor_id bigint NOT NULL,
+    action text NOT NULL,
+    details jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
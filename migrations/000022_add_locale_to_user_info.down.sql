@@ -0,0 +1,3 @@
+ALTER TABLE mail_outbox DROP COLUMN IF EXISTS locale;
+
+ALTER TABLE user_info DROP COLUMN IF EXISTS locale;
@@ -0,0 +1,3 @@
+ALTER TABLE user_info ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
+
+ALTER TABLE mail_outbox ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
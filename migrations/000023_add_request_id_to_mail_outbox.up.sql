@@ -0,0 +1 @@
+ALTER TABLE mail_outbox ADD COLUMN IF NOT EXISTS request_id text NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE mail_outbox ADD COLUMN IF NOT EXISTS redacted boolean NOT NULL DEFAULT false;
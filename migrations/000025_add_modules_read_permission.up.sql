@@ -0,0 +1,9 @@
+INSERT INTO permissions (code)
+VALUES ('modules:read')
+ON CONFLICT (code) DO NOTHING;
+
+-- Module and department info used to be readable by any activated user, and every
+-- account can read movies by default, so grant both to the existing accounts.
+INSERT INTO users_permissions
+SELECT u.id, p.id FROM user_info u, permissions p WHERE p.code IN ('movies:read', 'modules:read')
+ON CONFLICT DO NOTHING;
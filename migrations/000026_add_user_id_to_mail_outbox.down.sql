@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS mail_outbox_finished_idx;
+DROP INDEX IF EXISTS mail_outbox_user_id_idx;
+ALTER TABLE mail_outbox DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,11 @@
+ALTER TABLE mail_outbox ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES user_info ON DELETE CASCADE;
+
+-- Link the existing messages to their accounts by address. Messages which match no
+-- account are left unlinked, and are removed by the retention job once finished.
+UPDATE mail_outbox m
+SET user_id = u.id
+FROM user_info u
+WHERE m.user_id IS NULL AND (m.recipient = u.email OR m.recipient = u.pending_email);
+
+CREATE INDEX IF NOT EXISTS mail_outbox_user_id_idx ON mail_outbox (user_id);
+CREATE INDEX IF NOT EXISTS mail_outbox_finished_idx ON mail_outbox (updated_at) WHERE status <> 'pending';
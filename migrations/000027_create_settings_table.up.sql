@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS settings (
+    key text PRIMARY KEY,
+    value text NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);